@@ -0,0 +1,48 @@
+package notmuch
+
+// Go functions called back from libnotmuch. They live in a file of their own
+// because cgo does not allow C definitions in the preamble of a file that
+// exports functions.
+
+/*
+#include <stdint.h>
+*/
+import "C"
+import "sync"
+
+var compactProgressFuncs struct {
+	sync.Mutex
+	next  uintptr
+	funcs map[uintptr]func(string)
+}
+
+// Register fn for compactProgress and return the handle to pass to C.
+func registerCompactProgress(fn func(string)) uintptr {
+	p := &compactProgressFuncs
+	p.Lock()
+	defer p.Unlock()
+	if p.funcs == nil {
+		p.funcs = make(map[uintptr]func(string))
+	}
+	p.next++
+	p.funcs[p.next] = fn
+	return p.next
+}
+
+func unregisterCompactProgress(handle uintptr) {
+	p := &compactProgressFuncs
+	p.Lock()
+	delete(p.funcs, handle)
+	p.Unlock()
+}
+
+//export compactProgress
+func compactProgress(message *C.char, handle C.uintptr_t) {
+	p := &compactProgressFuncs
+	p.Lock()
+	fn := p.funcs[uintptr(handle)]
+	p.Unlock()
+	if fn != nil {
+		fn(C.GoString(message))
+	}
+}
@@ -0,0 +1,14 @@
+//go:build notmuch_leakcheck
+// +build notmuch_leakcheck
+
+package notmuch
+
+import "log"
+
+// Building with the notmuch_leakcheck tag logs a warning for every query the
+// garbage collector frees without it having been closed.
+func init() {
+	reportLeak = func(what string) {
+		log.Printf("notmuch: %s garbage collected without Close", what)
+	}
+}
@@ -6,14 +6,49 @@ package notmuch // import "github.com/nmsync/notmuch"
 #cgo LDFLAGS: -lnotmuch
 
 #include <stdlib.h>
+#include <stdint.h>
 #include <string.h>
 #include <time.h>
+#include <pthread.h>
 #include "notmuch.h"
+
+static uint64_t thread_id(void) {
+	return (uint64_t)(uintptr_t)pthread_self();
+}
+
+extern void compactProgress(char *message, uintptr_t handle);
+
+static void compact_progress(const char *message, void *closure) {
+	compactProgress((char *)message, (uintptr_t)closure);
+}
+
+static notmuch_status_t compact(const char *path, uintptr_t handle) {
+	return notmuch_database_compact(path, NULL, compact_progress, (void *)handle);
+}
 */
 import "C"
 import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
@@ -21,23 +56,129 @@ type status C.notmuch_status_t
 
 const (
 	statusSuccess            status = C.NOTMUCH_STATUS_SUCCESS
+	statusOutOfMemory        status = C.NOTMUCH_STATUS_OUT_OF_MEMORY
+	statusXapianException    status = C.NOTMUCH_STATUS_XAPIAN_EXCEPTION
+	statusFileNotEmail       status = C.NOTMUCH_STATUS_FILE_NOT_EMAIL
 	statusDuplicateMessageID status = C.NOTMUCH_STATUS_DUPLICATE_MESSAGE_ID
+	statusIgnored            status = C.NOTMUCH_STATUS_IGNORED
 )
 
-func (s status) Error() string {
-	return fmt.Sprintf("notmuch: %s", C.GoString(C.notmuch_status_to_string(C.notmuch_status_t(s))))
+// Error describes a failed libnotmuch call. Use errors.As to get at it:
+//
+//	var e notmuch.Error
+//	if errors.As(err, &e) { ... e.Code ... }
+type Error struct {
+	// The notmuch_status_t code returned by libnotmuch.
+	Code int
+	// The operation that failed, e.g. "index", if known.
+	Op string
+	// The filename, or for searches the query string, the operation was
+	// applied to, if any.
+	Path string
+	// Further detail reported by libnotmuch, if any.
+	Detail string
+}
+
+func (e Error) Error() string {
+	msg := "notmuch: "
+	if e.Op != "" {
+		msg += e.Op
+		if e.Path != "" {
+			msg += fmt.Sprintf(" %q", e.Path)
+		}
+		msg += ": "
+	}
+	msg += C.GoString(C.notmuch_status_to_string(C.notmuch_status_t(e.Code)))
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	return msg
 }
 
 func statusToError(st status) error {
 	if st == statusSuccess || st == statusDuplicateMessageID {
 		return nil
 	} else {
-		return st
+		return Error{Code: int(st)}
+	}
+}
+
+func opError(op, path string, st status) error {
+	return Error{Code: int(st), Op: op, Path: path}
+}
+
+// Like statusToError, but a Xapian exception gets the message libnotmuch
+// logged about it as its detail. libnotmuch logs the exception when it catches
+// it and never clears the message, so this must be called right after the
+// failing call, before anything else can log to the database.
+func (db *Database) statusError(st status) error {
+	return db.withDetail(statusToError(st))
+}
+
+// Like opError, with the detail of statusError.
+func (db *Database) opError(op, path string, st status) error {
+	return db.withDetail(opError(op, path, st))
+}
+
+func (db *Database) withDetail(err error) error {
+	e, ok := err.(Error)
+	if !ok || e.Code != int(statusXapianException) || e.Detail != "" || db.db == nil {
+		return err
+	}
+	if detail := C.notmuch_database_status_string(db.db); detail != nil {
+		e.Detail = strings.TrimSpace(C.GoString(detail))
 	}
+	return e
 }
 
+var (
+	// ErrDatabaseClosed is returned by Database methods called after Close.
+	ErrDatabaseClosed = errors.New("notmuch: database is closed")
+	// ErrMessageClosed is returned by Message methods called after Close.
+	ErrMessageClosed = errors.New("notmuch: message is closed")
+	// ErrQueryClosed is returned by Query and Messages methods called after
+	// Close.
+	ErrQueryClosed = errors.New("notmuch: query is closed")
+)
+
 type Database struct {
-	db *C.notmuch_database_t
+	db   *C.notmuch_database_t
+	mode C.notmuch_database_mode_t
+	opts OpenOptions
+	root string
+
+	// Handles replaced by CompactInPlace. They are only closed, so that
+	// objects still referring to them stay valid until Close destroys them.
+	retired []*C.notmuch_database_t
+
+	// Destructors queued by finalizers, see release.
+	mu      sync.Mutex
+	pending []func()
+
+	// Held by the outermost Do call, and the OS thread it runs on.
+	doMu    sync.Mutex
+	doOwner uint64
+
+	// Set while in bulk mode, and the number of writes since the bulk
+	// transaction was last committed.
+	bulk       bool
+	bulkWrites int
+
+	// Called for every indexed file, see SetIndexHook.
+	indexHook func(m *Message, merged bool)
+
+	// Set by SetStrictPaths.
+	strictPaths bool
+
+	// Message counts memoized by CachedCount.
+	countMu sync.Mutex
+	counts  map[string]cachedCount
+}
+
+type cachedCount struct {
+	count   int
+	rev     uint64
+	expires time.Time
 }
 
 // Create a new, empty notmuch database located at 'path'.
@@ -46,44 +187,575 @@ type Database struct {
 // messages (one message per file). This call will create a new ".notmuch"
 // directory within 'path' where notmuch will store its data.
 func New(path string) (*Database, error) {
-	var db Database
+	path = canonicalPath(path)
+	db := Database{mode: C.NOTMUCH_DATABASE_MODE_READ_WRITE, root: path}
 	cPath := C.CString(path)
 	st := status(C.notmuch_database_create(cPath, &db.db))
 	C.free(unsafe.Pointer(cPath))
 	if st != statusSuccess {
-		return nil, st
+		return nil, opError("create", path, st)
 	}
 	return &db, nil
 }
 
+// Create a new, empty notmuch database in a fresh temporary directory, for
+// tests and short-lived tools. The returned function closes the database and
+// removes the directory with everything in it.
+func NewTemp() (*Database, func(), error) {
+	dir, err := ioutil.TempDir("", "nm-")
+	if err != nil {
+		return nil, nil, err
+	}
+	db, err := New(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}, nil
+}
+
 // Open an existing notmuch database located at 'path'.
 //
 // The database should have been created at some time in the past, (not
 // necessarily by this process), by calling New with 'path'.
 func Open(path string, readOnly bool) (*Database, error) {
-	var db Database
-	var mode C.notmuch_database_mode_t
-	if readOnly {
-		mode = C.NOTMUCH_DATABASE_MODE_READ_ONLY
+	return OpenWith(path, OpenOptions{ReadOnly: readOnly})
+}
+
+// Options for opening a database with OpenWith.
+type OpenOptions struct {
+	// Open the database in read-only mode.
+	ReadOnly bool
+	// Path of a notmuch configuration file to load. If empty, no configuration
+	// file is loaded and only the configuration stored in the database is
+	// used.
+	ConfigPath string
+	// Configuration profile to use, as with NOTMUCH_PROFILE. If empty, the
+	// default profile is used.
+	Profile string
+}
+
+// Open an existing notmuch database located at 'path' with the given options.
+func OpenWith(path string, opts OpenOptions) (*Database, error) {
+	path = canonicalPath(path)
+	db := Database{opts: opts, root: path}
+	if opts.ReadOnly {
+		db.mode = C.NOTMUCH_DATABASE_MODE_READ_ONLY
 	} else {
-		mode = C.NOTMUCH_DATABASE_MODE_READ_WRITE
+		db.mode = C.NOTMUCH_DATABASE_MODE_READ_WRITE
+	}
+	if err := db.open(path); err != nil {
+		return nil, err
+	}
+	return &db, nil
+}
+
+// Make path absolute and resolve symbolic links in it, so that it can be
+// compared with the paths libnotmuch derives from the database root. If the
+// path cannot be resolved, it is only made absolute, and libnotmuch reports
+// the problem.
+func canonicalPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
 	}
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		path = real
+	}
+	return path
+}
+
+// Open the database at path with the mode and options of db.
+func (db *Database) open(path string) error {
+	opts := db.opts
 	cPath := C.CString(path)
-	st := status(C.notmuch_database_open(cPath, mode, &db.db))
-	C.free(unsafe.Pointer(cPath))
+	defer C.free(unsafe.Pointer(cPath))
+	cConfig := C.CString(opts.ConfigPath)
+	defer C.free(unsafe.Pointer(cConfig))
+	var cProfile *C.char
+	if opts.Profile != "" {
+		cProfile = C.CString(opts.Profile)
+		defer C.free(unsafe.Pointer(cProfile))
+	}
+	var cErr *C.char
+	st := status(C.notmuch_database_open_with_config(cPath, db.mode, cConfig, cProfile, &db.db, &cErr))
+	if cErr != nil {
+		defer C.free(unsafe.Pointer(cErr))
+	}
 	if st != statusSuccess {
-		return nil, st
+		err := Error{Code: int(st), Op: "open", Path: path}
+		if cErr != nil {
+			err.Detail = strings.TrimSpace(C.GoString(cErr))
+		}
+		return err
 	}
-	return &db, nil
+	return nil
+}
+
+// Open the notmuch database located at 'path', creating it first if it does not
+// exist yet.
+//
+// A missing database is never created when 'readOnly' is set; an error is
+// returned instead.
+func OpenOrCreate(path string, readOnly bool) (*Database, error) {
+	_, err := os.Stat(filepath.Join(path, ".notmuch"))
+	switch {
+	case err == nil:
+		return Open(path, readOnly)
+	case !os.IsNotExist(err):
+		return nil, err
+	case readOnly:
+		return nil, fmt.Errorf("notmuch: no database at %q to open read-only", path)
+	}
+	// A newly created database is already open in read-write mode.
+	return New(path)
+}
+
+// Open the database located at 'path' in read-only mode, call fn with it and
+// close it again.
+//
+// The database is closed even if fn panics. The error returned by fn takes
+// precedence over any error from closing the database.
+func WithReadOnly(path string, fn func(*Database) error) error {
+	return withDatabase(path, true, fn)
+}
+
+// Open the database located at 'path' in read-write mode, call fn with it and
+// close it again, committing any changes made by fn.
+//
+// The database is closed even if fn panics. The error returned by fn takes
+// precedence over any error from closing the database.
+func WithReadWrite(path string, fn func(*Database) error) error {
+	return withDatabase(path, false, fn)
+}
+
+func withDatabase(path string, readOnly bool, fn func(*Database) error) (err error) {
+	db, err := Open(path, readOnly)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := db.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	return fn(db)
 }
 
 // Close the given notmuch database, freeing all associated resources.
+//
+// In bulk mode, the bulk transaction is committed first. If that fails, the
+// database is still closed, the uncommitted changes are lost, and the error of
+// the commit is returned. Closing an already closed database does nothing.
 func (db *Database) Close() error {
-	return statusToError(status(C.notmuch_database_destroy(db.db)))
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.db == nil {
+		return nil
+	}
+	var bulkErr error
+	if db.bulk {
+		// Closing would abandon the open atomic section.
+		if st := status(C.notmuch_database_end_atomic(db.db)); st != statusSuccess {
+			bulkErr = db.statusError(st)
+		}
+		db.bulk = false
+	}
+	st := status(C.notmuch_database_destroy(db.db))
+	db.db = nil
+	for _, old := range db.retired {
+		C.notmuch_database_destroy(old)
+	}
+	db.retired = nil
+	// Destroying the database freed all objects belonging to it.
+	db.pending = nil
+	if bulkErr != nil {
+		return bulkErr
+	}
+	return statusToError(st)
+}
+
+// Queue the destruction of an object belonging to the database.
+//
+// Finalizers run on a goroutine of their own, concurrently with calls made on
+// the database, and libnotmuch is not safe for concurrent use. Instead of
+// destroying objects directly, finalizers hand them to release, and they are
+// destroyed at the start of the next call on the database, on the caller's
+// goroutine. If the database was closed in the meantime, the object has
+// already been freed along with it and is ignored.
+func (db *Database) release(destroy func()) {
+	db.mu.Lock()
+	if db.db != nil {
+		db.pending = append(db.pending, destroy)
+	}
+	db.mu.Unlock()
+}
+
+// Prepare the database for a call into libnotmuch: fail if it is closed, and
+// destroy the objects released by finalizers since the last call.
+func (db *Database) use() error {
+	db.mu.Lock()
+	closed := db.db == nil
+	pending := db.pending
+	db.pending = nil
+	db.mu.Unlock()
+	if closed {
+		return ErrDatabaseClosed
+	}
+	for _, destroy := range pending {
+		destroy()
+	}
+	return nil
+}
+
+// Like use, but also fail if the database is open in read-only mode. 'op'
+// names the operation in the error.
+func (db *Database) useWritable(op string) error {
+	if err := db.use(); err != nil {
+		return err
+	}
+	if db.mode == C.NOTMUCH_DATABASE_MODE_READ_ONLY {
+		return fmt.Errorf("notmuch: %s needs a read-write database", op)
+	}
+	return nil
+}
+
+// Run fn with the calling goroutine locked to its OS thread while holding a
+// lock that other calls to Do wait for, so that a sequence of calls such as
+// find, freeze, tag and thaw is neither interleaved with other Do calls nor
+// moved between threads halfway through.
+//
+// Do does not make the database safe for concurrent use. The lock is only
+// taken by Do: the other methods of Database, Message and Directory do not
+// wait for it, so a call made outside Do from another goroutine can still run
+// in the middle of fn. Goroutines sharing a database must make all of their
+// calls inside Do. Nested calls to Do from within fn are allowed and run fn
+// directly.
+func (db *Database) Do(fn func() error) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	// While the thread is locked, no other goroutine can run on it, so the
+	// thread identifies the goroutine holding doMu.
+	self := uint64(C.thread_id())
+	if atomic.LoadUint64(&db.doOwner) == self {
+		return fn()
+	}
+	db.doMu.Lock()
+	atomic.StoreUint64(&db.doOwner, self)
+	defer func() {
+		atomic.StoreUint64(&db.doOwner, 0)
+		db.doMu.Unlock()
+	}()
+	return fn()
+}
+
+// Commit the bulk transaction after this many writes.
+const bulkFlushInterval = 1000
+
+// Enable or disable bulk mode.
+//
+// In bulk mode, IndexFile, RemoveMessage and the tag changes made in between
+// run inside a single long-lived atomic transaction instead of each being
+// committed on its own, which makes large imports a lot faster. The
+// transaction is still committed every 1000 index or remove operations, and
+// when bulk mode is turned off or the database is closed.
+//
+// If committing the transaction fails when turning bulk mode off, the error
+// is returned and bulk mode stays on, since libnotmuch keeps the atomic
+// section open.
+func (db *Database) SetBulkMode(on bool) error {
+	if err := db.use(); err != nil {
+		return err
+	}
+	if on == db.bulk {
+		return nil
+	}
+	var st status
+	if on {
+		st = status(C.notmuch_database_begin_atomic(db.db))
+	} else {
+		st = status(C.notmuch_database_end_atomic(db.db))
+	}
+	if st != statusSuccess {
+		return db.statusError(st)
+	}
+	db.bulk = on
+	db.bulkWrites = 0
+	return nil
+}
+
+// Record a write for bulk mode, committing the bulk transaction if it is due.
+func (db *Database) bulkWrite() error {
+	if !db.bulk {
+		return nil
+	}
+	db.bulkWrites++
+	if db.bulkWrites < bulkFlushInterval {
+		return nil
+	}
+	db.bulkWrites = 0
+	// A failed end_atomic leaves the atomic section open in libnotmuch, so
+	// bulk mode stays on and a later commit, SetBulkMode(false) or Close ends
+	// it. A failed begin_atomic opens none, and bulk mode is over.
+	if st := status(C.notmuch_database_end_atomic(db.db)); st != statusSuccess {
+		return db.statusError(st)
+	}
+	if st := status(C.notmuch_database_begin_atomic(db.db)); st != statusSuccess {
+		db.bulk = false
+		return db.statusError(st)
+	}
+	return nil
+}
+
+// Report whether libnotmuch was built with the named optional feature, such
+// as "compact", "field_processor", "retry_lock" or "session_key".
+func BuiltWith(name string) bool {
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+	return C.notmuch_built_with(cName) != 0
+}
+
+// Compact the database, replacing it with the compacted copy and deleting the
+// old one. If progress is not nil, it is called with the progress messages of
+// libnotmuch.
+//
+// The database is closed for the duration and then opened again in the same
+// mode. Messages, directories and queries obtained before must be looked up
+// again; calls on them fail with ErrDatabaseClosed afterwards. If the database
+// cannot be opened again, it is left closed. Compacting is refused in bulk
+// mode.
+func (db *Database) CompactInPlace(progress func(string)) error {
+	if !BuiltWith("compact") {
+		return errors.New("notmuch: library built without compaction support")
+	}
+	if err := db.use(); err != nil {
+		return err
+	}
+	if db.bulk {
+		return errors.New("notmuch: cannot compact in bulk mode")
+	}
+	path := db.Path()
+	if st := status(C.notmuch_database_close(db.db)); st != statusSuccess {
+		return db.opError("compact", path, st)
+	}
+	db.mu.Lock()
+	db.retired = append(db.retired, db.db)
+	db.db = nil
+	db.mu.Unlock()
+
+	var handle uintptr
+	if progress != nil {
+		handle = registerCompactProgress(progress)
+		defer unregisterCompactProgress(handle)
+	}
+	cPath := C.CString(path)
+	st := status(C.compact(cPath, C.uintptr_t(handle)))
+	C.free(unsafe.Pointer(cPath))
+
+	// Reopen even if compacting failed, the old database is still in place
+	// then.
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.open(path); err != nil {
+		return err
+	}
+	if st != statusSuccess {
+		return opError("compact", path, st)
+	}
+	return nil
+}
+
+// Run fn inside an atomic section, retrying it up to maxRetries times when it
+// fails because the database was modified by another writer while fn was
+// reading (Xapian's DatabaseModifiedError). Before each retry the database is
+// refreshed to the latest revision. The error of the last attempt is returned.
+//
+// All changes made by fn are committed together when it succeeds. fn has to
+// be safe to run again: libnotmuch cannot roll back the changes of a failed
+// attempt.
+func (db *Database) WithAtomicRetry(fn func() error, maxRetries int) error {
+	for attempt := 0; ; attempt++ {
+		err := db.atomic(fn)
+		if err == nil || attempt >= maxRetries || !isModifiedError(err) {
+			return err
+		}
+		if err := db.Refresh(); err != nil {
+			return err
+		}
+	}
+}
+
+// Run fn inside an atomic section.
+func (db *Database) atomic(fn func() error) error {
+	if err := db.use(); err != nil {
+		return err
+	}
+	if st := status(C.notmuch_database_begin_atomic(db.db)); st != statusSuccess {
+		return db.statusError(st)
+	}
+	err := fn()
+	if db.db == nil {
+		// fn closed the database.
+		return err
+	}
+	if st := status(C.notmuch_database_end_atomic(db.db)); err == nil {
+		err = db.statusError(st)
+	}
+	return err
+}
+
+// Report whether err is a Xapian exception telling that the revision being
+// read was discarded by a concurrent write. libnotmuch reports all Xapian
+// exceptions with the same status, so this looks at the error details, which
+// are taken from the message libnotmuch logged right after the failing call.
+// The current status string of the database is not consulted: it keeps the
+// last message ever logged, which may belong to an earlier failure.
+func isModifiedError(err error) bool {
+	var e Error
+	if !errors.As(err, &e) || e.Code != int(statusXapianException) {
+		return false
+	}
+	return strings.Contains(e.Detail, "DatabaseModifiedError") ||
+		strings.Contains(e.Detail, "revision being read has been discarded")
+}
+
+// Reopen the database in its current mode, making changes written through other
+// handles since it was opened visible.
+//
+// Search results and iterators obtained before Refresh refer to the old state
+// of the database and must not be reused. Callers that get an error while
+// iterating after an external write should call Refresh and restart their
+// search from the beginning.
+//
+// In bulk mode, the bulk transaction is committed before reopening, since
+// reopening a read-write database would abandon it, and a new one is started
+// afterwards.
+func (db *Database) Refresh() error {
+	if err := db.use(); err != nil {
+		return err
+	}
+	if db.bulk {
+		if st := status(C.notmuch_database_end_atomic(db.db)); st != statusSuccess {
+			return db.statusError(st)
+		}
+		db.bulkWrites = 0
+	}
+	st := status(C.notmuch_database_reopen(db.db, db.mode))
+	if db.bulk {
+		if bst := status(C.notmuch_database_begin_atomic(db.db)); bst != statusSuccess {
+			db.bulk = false
+			if st == statusSuccess {
+				st = bst
+			}
+		}
+	}
+	return db.statusError(st)
+}
+
+// Switch the database between read-only and read-write mode by reopening it.
+//
+// The Database itself stays valid, but as with Refresh, messages and search
+// results obtained before should be looked up again. Switching to
+// read-write takes the database's write lock, and it is released again when
+// switching back to read-only, so a mostly-reading process only holds the lock
+// while it writes. Switching to read-only is refused in bulk mode.
+func (db *Database) SetMode(readOnly bool) error {
+	if err := db.use(); err != nil {
+		return err
+	}
+	mode := C.notmuch_database_mode_t(C.NOTMUCH_DATABASE_MODE_READ_WRITE)
+	if readOnly {
+		if db.bulk {
+			return errors.New("notmuch: cannot switch to read-only in bulk mode")
+		}
+		mode = C.NOTMUCH_DATABASE_MODE_READ_ONLY
+	}
+	if mode == db.mode {
+		return nil
+	}
+	if st := status(C.notmuch_database_reopen(db.db, mode)); st != statusSuccess {
+		return db.opError("reopen", db.Path(), st)
+	}
+	db.mode = mode
+	db.opts.ReadOnly = readOnly
+	return nil
+}
+
+// Return the path of the database root directory, or an empty string if the
+// database is closed.
+func (db *Database) Path() string {
+	if db.db == nil {
+		return ""
+	}
+	return C.GoString(C.notmuch_database_get_path(db.db))
+}
+
+// Get the root directory the database was opened or created with, made
+// absolute and with symbolic links resolved. Unlike Path, it is still
+// available after Close.
+//
+// Message filenames are always below this path, so paths to pass to
+// FindMessageByFilename or RemoveMessage should be built from it.
+func (db *Database) RootPath() string {
+	return db.root
+}
+
+// Get the current revision of the database, or 0 if it is closed.
+//
+// The revision increases with every committed change. Messages record the
+// revision they were last modified at, see Message.LastModified.
+func (db *Database) Revision() uint64 {
+	if db.db == nil {
+		return 0
+	}
+	return uint64(C.notmuch_database_get_revision(db.db, nil))
+}
+
+// A message changed since some database revision, as reported by ChangesSince.
+type Change struct {
+	// The message ID.
+	ID string
+	// The current tags of the message.
+	Tags []string
+	// The revision at which the message was last modified.
+	Rev uint64
+}
+
+// Report the messages modified after revision 'rev', e.g. the Revision() seen
+// by a previous sync.
+//
+// Each change holds the current state of a message, not a diff: callers get
+// the message's tags as they are now, not which tags were added or removed.
+// Finding each message's revision costs a few extra queries per message.
+func (db *Database) ChangesSince(rev uint64) ([]Change, error) {
+	if err := db.use(); err != nil {
+		return nil, err
+	}
+	var changes []Change
+	query := fmt.Sprintf("lastmod:%d..%d", rev+1, db.Revision())
+	err := db.searchMessages(query, func(m *Message) error {
+		mrev, err := m.LastModified()
+		if err != nil {
+			return err
+		}
+		changes = append(changes, Change{ID: m.ID(), Tags: m.Tags(), Rev: mrev})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
 }
 
 // Does this database need to be upgraded before writing to it?
+//
+// Always false for a closed database.
 func (db *Database) NeedsUpgrade() bool {
+	if db.db == nil {
+		return false
+	}
 	needsUpgrade := C.notmuch_database_needs_upgrade(db.db)
 	return needsUpgrade != 0
 }
@@ -92,18 +764,258 @@ func (db *Database) NeedsUpgrade() bool {
 // searches.  If a message already exists with the same message ID as the
 // specified file, their indexes will be merged, and this new filename will
 // also be associated with the existing message.
+//
+// If the file was indexed but running the index hook or committing the bulk
+// transaction failed afterwards, both the message and the error are returned.
 func (db *Database) IndexFile(path string) (*Message, error) {
-	var msg Message
+	res, err := db.IndexFileResult(path)
+	return res.Message, err
+}
+
+// The outcome of indexing a message file.
+type IndexResult struct {
+	// The indexed message.
+	Message *Message
+	// Set if the file was attached to an already existing message with the
+	// same message ID rather than creating a new one.
+	Merged bool
+}
+
+// Same as IndexFile, but also reports whether the file created a new message or
+// was merged into an existing one.
+func (db *Database) IndexFileResult(path string) (IndexResult, error) {
+	return db.indexFile(path, nil)
+}
+
+// Index the file at path with the given options, see IndexOpts.
+func (db *Database) indexFile(path string, opts *IndexOpts) (IndexResult, error) {
+	if err := db.checkManaged(path); err != nil {
+		return IndexResult{}, err
+	}
+	cOpts, err := db.indexOpts(opts)
+	if err != nil {
+		return IndexResult{}, err
+	}
+	if cOpts != nil {
+		defer C.notmuch_indexopts_destroy(cOpts)
+	}
+	msg := Message{db: db, owner: db.db}
 	cPath := C.CString(path)
-	st := status(C.notmuch_database_index_file(db.db, cPath, nil, &msg.msg))
+	st := status(C.notmuch_database_index_file(db.db, cPath, cOpts, &msg.msg))
 	C.free(unsafe.Pointer(cPath))
 	switch st {
 	case statusSuccess, statusDuplicateMessageID:
 		runtime.SetFinalizer(&msg, finalizeMessage)
-		return &msg, nil
+		res := IndexResult{Message: &msg, Merged: st == statusDuplicateMessageID}
+		if err := msg.setIndexedAt(); err != nil {
+			return res, err
+		}
+		if err := db.bulkWrite(); err != nil {
+			return res, err
+		}
+		return res, db.runIndexHook(res)
 	default:
-		return nil, st
+		return IndexResult{}, db.opError("index", path, st)
+	}
+}
+
+// Set a function to be called after each file is successfully indexed, with
+// the message and whether the file was merged into an existing one. It runs
+// for files indexed through IndexFile, IndexFileResult, IndexBytes and
+// Deliver. Pass nil to remove the hook.
+//
+// If the hook panics, the panic is recovered and returned as an error from
+// the indexing call; the file stays indexed.
+func (db *Database) SetIndexHook(fn func(m *Message, merged bool)) {
+	db.indexHook = fn
+}
+
+func (db *Database) runIndexHook(res IndexResult) (err error) {
+	if db.indexHook == nil {
+		return nil
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("notmuch: index hook panicked: %v", r)
+		}
+	}()
+	db.indexHook(res.Message, res.Merged)
+	return nil
+}
+
+// Write an in-memory message to a new file in the database root directory and
+// index it with the given options, or the database's defaults if opts is nil.
+// The new file's path is available through Message.FileName().
+//
+// If indexing fails, the file is removed again.
+func (db *Database) IndexBytes(data []byte, opts *IndexOpts) (*Message, error) {
+	if err := db.use(); err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(db.Path(), "msg-")
+	if err != nil {
+		return nil, err
+	}
+	path := f.Name()
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	res, err := db.indexFile(path, opts)
+	msg := res.Message
+	if msg == nil {
+		os.Remove(path)
+		return nil, err
+	} else if err != nil {
+		// Indexed, but the index hook or a bulk commit failed.
+		return msg, err
+	}
+	return msg, nil
+}
+
+// Index the message read from content as the message file at path, which may
+// be relative to the database root and must not exist yet, with the given
+// options or the database's defaults if opts is nil.
+//
+// libnotmuch can only index files it reads itself, so the content is written
+// to a temporary file in the directory of path, which is created as needed,
+// then moved to path and indexed there. The file at path holds the content
+// afterwards: a file cannot be indexed in place from other content, such as a
+// compressed message, since libnotmuch reads it again when reindexing.
+//
+// If indexing fails, the file is removed again.
+func (db *Database) IndexFileWithContent(path string, content io.Reader, opts *IndexOpts) (*Message, error) {
+	if err := db.use(); err != nil {
+		return nil, err
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(db.Path(), path)
+	}
+	if err := db.checkManaged(path); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".index-")
+	if err != nil {
+		return nil, err
+	}
+	tmp := f.Name()
+	_, err = io.Copy(f, content)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		// Unlike os.Rename, os.Link fails if path exists.
+		err = os.Link(tmp, path)
+	}
+	os.Remove(tmp)
+	if err != nil {
+		return nil, err
+	}
+	res, err := db.indexFile(path, opts)
+	if res.Message == nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return res.Message, err
+}
+
+// Deliver a message into the maildir 'folder', relative to the database root,
+// index it and add 'initialTags' to it.
+//
+// The file is written to the folder's tmp/ directory under a unique maildir
+// name and then moved to new/; the maildir directories are created as needed.
+// A folder outside the database root or inside its .notmuch directory is
+// refused. If indexing or tagging fails, the message is removed again.
+func (db *Database) Deliver(content []byte, folder string, initialTags []string) (*Message, error) {
+	if err := db.use(); err != nil {
+		return nil, err
+	}
+	dir, err := db.folderDir(folder)
+	if err != nil {
+		return nil, err
+	}
+	if err := makeMaildir(dir); err != nil {
+		return nil, err
+	}
+	name := maildirName()
+	tmp := filepath.Join(dir, "tmp", name)
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	path := filepath.Join(dir, "new", name)
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	msg, err := db.IndexFile(path)
+	if msg == nil {
+		os.Remove(path)
+		return nil, err
+	} else if err != nil {
+		// Indexed, but the index hook or a bulk commit failed.
+		return msg, err
 	}
+	if err = msg.addTags(initialTags); err != nil {
+		db.RemoveMessage(path)
+		os.Remove(path)
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Get the directory of the maildir 'folder', relative to the database root.
+// Folders that are absolute, outside the root or inside its .notmuch
+// directory are refused; "" is the root itself.
+func (db *Database) folderDir(folder string) (string, error) {
+	if filepath.IsAbs(folder) {
+		return "", fmt.Errorf("notmuch: folder %q is not relative to the database root", folder)
+	}
+	root := db.Path()
+	dir := filepath.Join(root, folder)
+	if dir == root {
+		return dir, nil
+	}
+	ok, err := db.IsManagedPath(dir)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("notmuch: folder %q is outside the database", folder)
+	}
+	return dir, nil
+}
+
+// Create the tmp/, new/ and cur/ directories of the maildir 'dir'.
+func makeMaildir(dir string) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var deliveries uint64
+
+// Generate a unique maildir filename of the form
+// "<seconds>.M<microseconds>P<pid>Q<counter>.<hostname>".
+func maildirName() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	host = strings.NewReplacer("/", "\\057", ":", "\\072").Replace(host)
+	now := time.Now()
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000,
+		os.Getpid(), atomic.AddUint64(&deliveries, 1), host)
 }
 
 // Remove a message filename from the given notmuch database. If the message
@@ -114,29 +1026,87 @@ func (db *Database) IndexFile(path string) (*Message, error) {
 // filenames. When the last filename is removed for a particular message, the
 // database content for that message will be entirely removed.
 func (db *Database) RemoveMessage(path string) (hasMore bool, err error) {
+	if err := db.checkManaged(path); err != nil {
+		return false, err
+	}
 	cPath := C.CString(path)
 	st := status(C.notmuch_database_remove_message(db.db, cPath))
 	C.free(unsafe.Pointer(cPath))
 	switch st {
 	case statusSuccess:
-		return false, nil
+		return false, db.bulkWrite()
 	case statusDuplicateMessageID:
-		return true, nil
+		return true, db.bulkWrite()
 	default:
-		return false, st
+		return false, db.opError("remove", path, st)
 	}
 }
 
+// Report whether path is a message file location inside the database root.
+// Relative paths are taken relative to the root, as libnotmuch does. Paths
+// inside the ".notmuch" directory are not managed.
+//
+// The check is done on the path names only. The root is canonical, with
+// symbolic links resolved (see RootPath), but path is taken as given, so
+// callers must pass canonical paths, such as those built from RootPath. A
+// path through a symbolic link to the root, e.g. ~/mail when that links to
+// /data/mail, is reported as unmanaged, and refused in strict mode; libnotmuch
+// would not recognize it as being below the root either.
+func (db *Database) IsManagedPath(path string) (bool, error) {
+	if err := db.use(); err != nil {
+		return false, err
+	}
+	root := db.Path()
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(root, path)
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false, err
+	}
+	first := strings.SplitN(rel, string(filepath.Separator), 2)[0]
+	return first != "." && first != ".." && first != ".notmuch", nil
+}
+
+// Make IndexFile and RemoveMessage fail for paths that are not managed by
+// the database, as reported by IsManagedPath, instead of passing them on to
+// libnotmuch. This is off by default.
+func (db *Database) SetStrictPaths(on bool) {
+	db.strictPaths = on
+}
+
+// Prepare the database for a call on the message file at path, rejecting
+// unmanaged paths in strict mode.
+func (db *Database) checkManaged(path string) error {
+	if err := db.use(); err != nil {
+		return err
+	}
+	if !db.strictPaths {
+		return nil
+	}
+	ok, err := db.IsManagedPath(path)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("notmuch: %q is outside the database root %q", path, db.Path())
+	}
+	return nil
+}
+
 // Find a message with the given id.
 //
 // Returns nil if message with the given id is not found.
 func (db *Database) FindMessage(id string) (*Message, error) {
-	var msg Message
+	if err := db.use(); err != nil {
+		return nil, err
+	}
+	msg := Message{db: db, owner: db.db}
 	cID := C.CString(id)
 	st := status(C.notmuch_database_find_message(db.db, cID, &msg.msg))
 	C.free(unsafe.Pointer(cID))
 	if st != statusSuccess {
-		return nil, st
+		return nil, db.statusError(st)
 	}
 	if msg.msg == nil {
 		return nil, nil
@@ -145,58 +1115,2525 @@ func (db *Database) FindMessage(id string) (*Message, error) {
 	return &msg, nil
 }
 
+// Get the database revision at which the message with the given id was last
+// modified, as Message.LastModified does. It is an error if there is no such
+// message.
+func (db *Database) MessageRevision(id string) (uint64, error) {
+	msg, err := db.FindMessage(id)
+	if err != nil {
+		return 0, err
+	}
+	if msg == nil {
+		return 0, fmt.Errorf("notmuch: no message with id %q", id)
+	}
+	defer msg.Close()
+	return msg.LastModified()
+}
+
+// Find the messages with the given ids. Ids that are not found are absent
+// from the result.
+//
+// Each id is looked up directly, like FindMessage does. A single combined
+// search would not be cheaper: messages returned by a search belong to its
+// query and would have to be looked up again to outlive it.
+func (db *Database) FindMessagesByIDs(ids []string) (map[string]*Message, error) {
+	msgs := make(map[string]*Message, len(ids))
+	for _, id := range ids {
+		msg, err := db.FindMessage(id)
+		if err != nil {
+			return nil, err
+		}
+		if msg != nil {
+			msgs[id] = msg
+		}
+	}
+	return msgs, nil
+}
+
+// Check whether a message with the given id exists.
+//
+// This is cheaper than FindMessage when the message itself is not needed, as
+// the message is released right away instead of being left to the garbage
+// collector.
+func (db *Database) MessageExists(id string) (bool, error) {
+	if err := db.use(); err != nil {
+		return false, err
+	}
+	var msg *C.notmuch_message_t
+	cID := C.CString(id)
+	st := status(C.notmuch_database_find_message(db.db, cID, &msg))
+	C.free(unsafe.Pointer(cID))
+	if st != statusSuccess {
+		return false, db.statusError(st)
+	}
+	if msg == nil {
+		return false, nil
+	}
+	C.notmuch_message_destroy(msg)
+	return true, nil
+}
+
+// Find a message with the given filename.
+//
+// Returns nil if no message is associated with the filename.
+func (db *Database) FindMessageByFilename(path string) (*Message, error) {
+	if err := db.use(); err != nil {
+		return nil, err
+	}
+	msg := Message{db: db, owner: db.db}
+	cPath := C.CString(path)
+	st := status(C.notmuch_database_find_message_by_filename(db.db, cPath, &msg.msg))
+	C.free(unsafe.Pointer(cPath))
+	if st != statusSuccess {
+		return nil, db.opError("find", path, st)
+	}
+	if msg.msg == nil {
+		return nil, nil
+	}
+	runtime.SetFinalizer(&msg, finalizeMessage)
+	return &msg, nil
+}
+
+// Get the value of a configuration key stored in the database.
+//
+// Returns an empty string if the key is not set.
+func (db *Database) GetConfig(key string) (string, error) {
+	if err := db.use(); err != nil {
+		return "", err
+	}
+	var cValue *C.char
+	cKey := C.CString(key)
+	st := status(C.notmuch_database_get_config(db.db, cKey, &cValue))
+	C.free(unsafe.Pointer(cKey))
+	if st != statusSuccess {
+		return "", db.statusError(st)
+	}
+	value := C.GoString(cValue)
+	C.free(unsafe.Pointer(cValue))
+	return value, nil
+}
+
+// Get the directory holding the hooks notmuch runs, such as pre-new and
+// post-new: the "database.hook_dir" setting if there is one, and the
+// ".notmuch/hooks" directory of the database otherwise. A relative setting is
+// taken relative to the database root. The directory need not exist.
+func (db *Database) HooksPath() (string, error) {
+	dir, err := db.GetConfig("database.hook_dir")
+	if err != nil {
+		return "", err
+	}
+	if dir == "" {
+		return filepath.Join(db.Path(), ".notmuch", "hooks"), nil
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(db.Path(), dir)
+	}
+	return dir, nil
+}
+
+// Set the value of a configuration key stored in the database.
+func (db *Database) SetConfig(key, value string) error {
+	if err := db.use(); err != nil {
+		return err
+	}
+	cKey := C.CString(key)
+	defer C.free(unsafe.Pointer(cKey))
+	cValue := C.CString(value)
+	defer C.free(unsafe.Pointer(cValue))
+	return db.statusError(status(C.notmuch_database_set_config(db.db, cKey, cValue)))
+}
+
+// notmuch separates the items of list-valued configuration keys with ';'.
+const configListSeparator = ";"
+
+// Get the items of a list-valued configuration key such as "new.tags".
+//
+// Empty items are skipped. Returns nil if the key is not set.
+func (db *Database) GetConfigValues(key string) ([]string, error) {
+	value, err := db.GetConfig(key)
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	for _, v := range strings.Split(value, configListSeparator) {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values, nil
+}
+
+// Set the items of a list-valued configuration key such as "new.tags".
+func (db *Database) SetConfigValues(key string, values []string) error {
+	return db.SetConfig(key, strings.Join(values, configListSeparator))
+}
+
+// Whether and how encrypted message parts are decrypted while indexing.
+type DecryptPolicy int
+
+const (
+	// Never decrypt.
+	DecryptFalse DecryptPolicy = iota
+	// Decrypt when possible, and stash the session keys with the message.
+	DecryptTrue
+	// Decrypt only using session keys already stashed with the message.
+	DecryptAuto
+	// Decrypt when possible, without stashing the session keys.
+	DecryptNoStash
+)
+
+// The values of the "index.decrypt" configuration key, by policy.
+var decryptPolicyNames = []string{"false", "true", "auto", "nostash"}
+
+func (p DecryptPolicy) String() string {
+	if p >= 0 && int(p) < len(decryptPolicyNames) {
+		return decryptPolicyNames[p]
+	}
+	return "DecryptPolicy(" + strconv.Itoa(int(p)) + ")"
+}
+
+// Options for indexing a message, for the calls that take them. A nil
+// *IndexOpts stands for the database's defaults, which follow the
+// configuration, see SetDefaultDecryptPolicy.
+type IndexOpts struct {
+	// Whether and how to decrypt encrypted parts. The zero value never
+	// decrypts.
+	DecryptPolicy DecryptPolicy
+}
+
+// The libnotmuch decryption policies, by DecryptPolicy.
+var cDecryptPolicies = []C.notmuch_decryption_policy_t{
+	DecryptFalse:   C.NOTMUCH_DECRYPT_FALSE,
+	DecryptTrue:    C.NOTMUCH_DECRYPT_TRUE,
+	DecryptAuto:    C.NOTMUCH_DECRYPT_AUTO,
+	DecryptNoStash: C.NOTMUCH_DECRYPT_NOSTASH,
+}
+
+// Get the libnotmuch index options for opts, which the caller must destroy,
+// or nil for the defaults if opts is nil.
+func (db *Database) indexOpts(opts *IndexOpts) (*C.notmuch_indexopts_t, error) {
+	if opts == nil {
+		return nil, nil
+	}
+	p := opts.DecryptPolicy
+	if p < 0 || int(p) >= len(cDecryptPolicies) {
+		return nil, fmt.Errorf("notmuch: invalid decryption policy %d", int(p))
+	}
+	cOpts := C.notmuch_database_get_default_indexopts(db.db)
+	if cOpts == nil {
+		return nil, statusToError(statusOutOfMemory)
+	}
+	if st := status(C.notmuch_indexopts_set_decrypt_policy(cOpts, cDecryptPolicies[p])); st != statusSuccess {
+		C.notmuch_indexopts_destroy(cOpts)
+		return nil, db.statusError(st)
+	}
+	return cOpts, nil
+}
+
+// Set the decryption policy used when indexing messages, by storing it under
+// the "index.decrypt" configuration key. IndexFile and the other indexing
+// calls use the database's default index options, which follow this key.
+func (db *Database) SetDefaultDecryptPolicy(policy DecryptPolicy) error {
+	if policy < 0 || int(policy) >= len(decryptPolicyNames) {
+		return fmt.Errorf("notmuch: invalid decryption policy %d", int(policy))
+	}
+	return db.SetConfig("index.decrypt", policy.String())
+}
+
+// Return a list of all tags used in the database.
+func (db *Database) AllTags() (tags []string, err error) {
+	err = db.ForEachTag(func(tag string) error {
+		tags = append(tags, tag)
+		return nil
+	})
+	return
+}
+
+// Call fn for each tag used in the database, without building the whole list.
+//
+// Iteration stops at the first error returned by fn, and that error is
+// returned.
+func (db *Database) ForEachTag(fn func(tag string) error) error {
+	if err := db.use(); err != nil {
+		return err
+	}
+	cTags := C.notmuch_database_get_all_tags(db.db)
+	if cTags == nil {
+		return statusToError(statusXapianException)
+	}
+	return iterateTags(cTags, fn)
+}
+
+// Call fn for each tag in cTags, stopping at the first error. The tags iterator
+// is destroyed before returning.
+func iterateTags(cTags *C.notmuch_tags_t, fn func(tag string) error) error {
+	if cTags == nil {
+		return nil
+	}
+	defer C.notmuch_tags_destroy(cTags)
+	for v := C.notmuch_tags_valid(cTags); v != 0; v = C.notmuch_tags_valid(cTags) {
+		if err := fn(C.GoString(C.notmuch_tags_get(cTags))); err != nil {
+			return err
+		}
+		C.notmuch_tags_move_to_next(cTags)
+	}
+	return nil
+}
+
+type Directory struct {
+	dir  *C.notmuch_directory_t
+	db   *Database
+	path string
+
+	// The database handle the directory belongs to, as for Message.
+	owner *C.notmuch_database_t
+}
+
+// Check that the directory is still usable: it was not deleted and the
+// database handle it belongs to is still open. Either way it is
+// ErrDatabaseClosed, as a deleted directory no longer has a database document.
+func (d *Directory) check() error {
+	if d.dir == nil || d.db.db == nil || d.db.db != d.owner {
+		return ErrDatabaseClosed
+	}
+	return nil
+}
+
+func finalizeDirectory(dir *Directory) {
+	cDir := dir.dir
+	dir.db.release(func() { C.notmuch_directory_destroy(cDir) })
+}
+
+// Get the directory object for 'path', which may be absolute or relative to the
+// database root.
+//
+// In read-write mode the directory document is created if it does not exist
+// yet. In read-only mode nil is returned for an unknown directory.
+func (db *Database) Directory(path string) (*Directory, error) {
+	if err := db.use(); err != nil {
+		return nil, err
+	}
+	dir := Directory{db: db, path: path, owner: db.db}
+	if !filepath.IsAbs(path) {
+		dir.path = filepath.Join(db.Path(), path)
+	}
+	cPath := C.CString(path)
+	st := status(C.notmuch_database_get_directory(db.db, cPath, &dir.dir))
+	C.free(unsafe.Pointer(cPath))
+	if st != statusSuccess {
+		return nil, db.opError("directory", path, st)
+	}
+	if dir.dir == nil {
+		return nil, nil
+	}
+	runtime.SetFinalizer(&dir, finalizeDirectory)
+	return &dir, nil
+}
+
+// Get the modification time stored for the directory, or the zero time if none
+// was stored yet.
+func (d *Directory) MTime() time.Time {
+	if d.check() != nil {
+		return time.Time{}
+	}
+	mtime := C.notmuch_directory_get_mtime(d.dir)
+	if mtime == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(mtime), 0)
+}
+
+// Get the names of the files in the directory that are indexed in the
+// database. Names are relative to the directory.
+func (d *Directory) ChildFiles() []string {
+	if d.check() != nil {
+		return nil
+	}
+	return filenamesToSlice(C.notmuch_directory_get_child_files(d.dir))
+}
+
+// Get the names of the subdirectories of the directory that are known to the
+// database. Names are relative to the directory.
+func (d *Directory) ChildDirectories() []string {
+	if d.check() != nil {
+		return nil
+	}
+	return filenamesToSlice(C.notmuch_directory_get_child_directories(d.dir))
+}
+
+// Delete the directory document from the database. Afterwards, methods of the
+// directory return zero values or ErrDatabaseClosed.
+//
+// This does not touch the files in the directory or their messages; callers
+// should remove those first.
+func (d *Directory) Delete() error {
+	if err := d.check(); err != nil {
+		return err
+	}
+	st := status(C.notmuch_directory_delete(d.dir))
+	runtime.SetFinalizer(d, nil)
+	d.dir = nil
+	return d.db.statusError(st)
+}
+
+// Count the regular files currently in the directory on disk.
+//
+// Comparing this with the number of ChildFiles is a cheap way for a scanner to
+// spot directories whose contents no longer match the index, even if their
+// mtime looks unchanged.
+func (d *Directory) FileCountOnDisk() (int, error) {
+	entries, err := ioutil.ReadDir(d.path)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, fi := range entries {
+		if fi.Mode().IsRegular() {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Store the modification time of the directory.
+//
+// Callers should set it to the directory's on-disk mtime after all of its files
+// have been indexed, so that a later scan can skip it if the mtime is
+// unchanged.
+func (d *Directory) SetMTime(mtime time.Time) error {
+	if err := d.check(); err != nil {
+		return err
+	}
+	return d.db.statusError(status(C.notmuch_directory_set_mtime(d.dir, C.time_t(mtime.Unix()))))
+}
+
+// Report whether the directory's mtime on disk differs from the stored one,
+// meaning that files were added to or removed from it since it was last
+// scanned.
+func (d *Directory) NeedsScan() (bool, error) {
+	if err := d.check(); err != nil {
+		return false, err
+	}
+	fi, err := os.Stat(d.path)
+	if err != nil {
+		return false, err
+	}
+	return d.MTime().Unix() != fi.ModTime().Unix(), nil
+}
+
+// Count the number of messages with 'tag' per time bucket of the given
+// duration.
+//
+// Each message is counted in the bucket its date falls in, as computed by
+// time.Time.Truncate. The keys of the result are the bucket start times in UTC.
+func (db *Database) TagHistogram(tag string, bucket time.Duration) (map[time.Time]int, error) {
+	hist := make(map[time.Time]int)
+	err := db.searchMessages("tag:"+quoteTerm(tag), func(m *Message) error {
+		hist[m.Date().UTC().Truncate(bucket)]++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hist, nil
+}
+
+// Find the messages that have more than one filename, e.g. because the same
+// message was delivered into several folders.
+//
+// Returns a map from message ID to all of the message's filenames.
+func (db *Database) Duplicates() (map[string][]string, error) {
+	dups := make(map[string][]string)
+	err := db.searchMessages("*", func(m *Message) error {
+		if m.CountFiles() > 1 {
+			dups[m.ID()] = m.FileNames()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dups, nil
+}
+
+// Call fn with the ID and each of the filenames of every message matching
+// query, stopping at the first error fn returns.
+func (db *Database) ForEachMessageFile(query string, fn func(id, path string) error) error {
+	return db.searchMessages(query, func(m *Message) error {
+		id := m.ID()
+		for _, name := range m.FileNames() {
+			if err := fn(id, name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Names of the entries in an archive written by ExportArchive.
+const (
+	archiveMailDir = "mail/"
+	archiveDump    = "dump"
+)
+
+// Write a tar archive of the messages matching query to w.
+//
+// The archive holds every file of each message under "mail/", at its path
+// relative to the database root, followed by a "dump" file with the tags of
+// the messages in the format of "notmuch dump", which "notmuch restore" also
+// reads. Message files are streamed from disk as they are found.
+func (db *Database) ExportArchive(w io.Writer, query string) error {
+	root := db.Path()
+	tw := tar.NewWriter(w)
+	var dump bytes.Buffer
+	err := db.searchMessages(query, func(m *Message) error {
+		for _, name := range m.FileNames() {
+			rel, err := filepath.Rel(root, name)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				return fmt.Errorf("notmuch: message file %q is outside the database", name)
+			}
+			if err := archiveFile(tw, name, archiveMailDir+filepath.ToSlash(rel)); err != nil {
+				return err
+			}
+		}
+		for _, tag := range m.Tags() {
+			dump.WriteString("+" + dumpEncode(tag) + " ")
+		}
+		dump.WriteString("-- " + dumpIDTerm(m.ID()) + "\n")
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Name:    archiveDump,
+		Mode:    0600,
+		Size:    int64(dump.Len()),
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := dump.WriteTo(tw); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// Add the file at path to tw as an entry with the given name.
+func archiveFile(tw *tar.Writer, path, name string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// Characters left as is by the hex escaping of "notmuch dump".
+const dumpSafeChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+-_@=.,"
+
+// Escape a tag for a dump line the way "notmuch dump" does.
+func dumpEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(dumpSafeChars, s[i]) >= 0 {
+			b.WriteByte(s[i])
+		} else {
+			fmt.Fprintf(&b, "%%%02x", s[i])
+		}
+	}
+	return b.String()
+}
+
+// Write the id: term of a message for a dump line the way "notmuch dump" does
+// with make_boolean_term: bare if possible, and otherwise in double quotes,
+// with quotes inside doubled. IDs are not hex escaped like tags.
+func dumpIDTerm(id string) string {
+	for i := 0; i < len(id); i++ {
+		if c := id[i]; c <= ' ' || c == '"' || c == '(' || c == ')' || c >= 0x80 {
+			return "id:" + quoteTerm(id)
+		}
+	}
+	return "id:" + id
+}
+
+// Undo dumpIDTerm, given the text following "id:".
+func parseDumpID(s string) (string, error) {
+	if !strings.HasPrefix(s, `"`) {
+		return strings.TrimSpace(s), nil
+	}
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		if s[i] != '"' {
+			b.WriteByte(s[i])
+		} else if i+1 < len(s) && s[i+1] == '"' {
+			b.WriteByte('"')
+			i++
+		} else {
+			return b.String(), nil
+		}
+	}
+	return "", fmt.Errorf("notmuch: unterminated id in dump %q", s)
+}
+
+// Undo dumpEncode.
+func dumpDecode(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("notmuch: bad escape in dump %q", s)
+		}
+		c, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("notmuch: bad escape in dump %q", s)
+		}
+		b.WriteByte(byte(c))
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// Read an archive written by ExportArchive, possibly from another database.
+//
+// The message files are written below destRoot, which must be the database
+// root or inside it as reported by IsManagedPath, at their archived paths, and
+// indexed. A relative destRoot is taken relative to the database root. Their
+// tags are then set to the ones in the archive's dump. Existing files are
+// never overwritten. It returns the number of messages imported.
+//
+// The import runs in a single atomic section. If it fails, the files written
+// so far are removed from the database and from disk again. Tags already
+// restored from the dump are not rolled back, though: messages the import
+// merged into existing ones keep the tags of the archive if an entry after
+// the dump fails.
+func (db *Database) ImportArchive(r io.Reader, destRoot string) (n int, err error) {
+	if err := db.use(); err != nil {
+		return 0, err
+	}
+	if !filepath.IsAbs(destRoot) {
+		destRoot = filepath.Join(db.Path(), destRoot)
+	}
+	if filepath.Clean(destRoot) != filepath.Clean(db.Path()) {
+		ok, err := db.IsManagedPath(destRoot)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			return 0, fmt.Errorf("notmuch: import destination %s is outside the database", destRoot)
+		}
+	}
+	if st := status(C.notmuch_database_begin_atomic(db.db)); st != statusSuccess {
+		return 0, db.statusError(st)
+	}
+	var written []string
+	defer func() {
+		if err != nil {
+			for _, path := range written {
+				db.RemoveMessage(path)
+				os.Remove(path)
+			}
+			n = 0
+		}
+		st := status(C.notmuch_database_end_atomic(db.db))
+		if err == nil {
+			err = db.statusError(st)
+		}
+	}()
+
+	ids := make(map[string]bool)
+	haveDump := false
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case hdr.Name == archiveDump:
+			haveDump = true
+			if err := db.restoreDump(tr, ids); err != nil {
+				return 0, err
+			}
+		case strings.HasPrefix(hdr.Name, archiveMailDir) && hdr.Typeflag == tar.TypeReg:
+			rel := filepath.FromSlash(strings.TrimPrefix(hdr.Name, archiveMailDir))
+			path := filepath.Join(destRoot, rel)
+			if rel, err := filepath.Rel(destRoot, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				return 0, fmt.Errorf("notmuch: archive entry %q is outside the destination", hdr.Name)
+			}
+			// destRoot may be the database root, whose .notmuch directory is
+			// not for mail.
+			ok, err := db.IsManagedPath(path)
+			if err != nil {
+				return 0, err
+			}
+			if !ok {
+				return 0, fmt.Errorf("notmuch: archive entry %q is outside the database", hdr.Name)
+			}
+			if err := extractFile(tr, path, hdr.ModTime); err != nil {
+				return 0, err
+			}
+			written = append(written, path)
+			msg, err := db.IndexFile(path)
+			if msg == nil {
+				return 0, err
+			}
+			ids[msg.ID()] = true
+			msg.Close()
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	if !haveDump {
+		return 0, errors.New("notmuch: archive has no dump")
+	}
+	return len(ids), nil
+}
+
+// Write the contents of r to a new file at path.
+func extractFile(r io.Reader, path string, mtime time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chtimes(path, mtime, mtime)
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// Set the tags of the messages in ids to the ones listed for them in a dump.
+func (db *Database) restoreDump(r io.Reader, ids map[string]bool) error {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+		i := strings.Index(line, "-- id:")
+		if i < 0 {
+			continue
+		}
+		id, err := parseDumpID(line[i+len("-- id:"):])
+		if err != nil {
+			return err
+		}
+		if !ids[id] {
+			continue
+		}
+		var tags []string
+		for _, f := range strings.Fields(line[:i]) {
+			tag, err := dumpDecode(strings.TrimPrefix(f, "+"))
+			if err != nil {
+				return err
+			}
+			tags = append(tags, tag)
+		}
+		msg, err := db.FindMessage(id)
+		if err != nil {
+			return err
+		}
+		if msg == nil {
+			continue
+		}
+		err = msg.setTags(tags)
+		msg.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+// Options for Database.Reconcile.
+type ReconcileOpts struct {
+	// Set the tags of newly indexed files from their maildir flags, see
+	// Message.AddTagsFromFilename.
+	SyncMaildirFlags bool
+}
+
+// The changes made by Database.Reconcile.
+type ReconcileReport struct {
+	// Files indexed as new messages.
+	Added int
+	// Filenames removed from the index because the file no longer exists.
+	Removed int
+	// Files indexed as another filename of an existing message, e.g. after a
+	// maildir flag change renamed the file.
+	Updated int
+}
+
+// Bring the index up to date with the directory tree 'root', which may be
+// absolute or relative to the database root: index new files, remove the
+// filenames of files that no longer exist, and store directory mtimes.
+//
+// Directories whose mtime matches the one stored by a previous run are not
+// scanned again, as files can only have been added or removed if the mtime
+// changed. Their subdirectories are still visited. As with "notmuch new", the
+// ".notmuch" directory, the tmp/ directories of maildirs and files that are not
+// email are skipped.
+//
+// A tmp/ directory only counts as part of a maildir once its cur/ and new/
+// siblings exist. Files indexed from it before that are left in the index by
+// later runs, since the directory is no longer visited; remove them with
+// RemoveMessage.
+func (db *Database) Reconcile(root string, opts ReconcileOpts) (ReconcileReport, error) {
+	var report ReconcileReport
+	if err := db.useWritable("Reconcile"); err != nil {
+		return report, err
+	}
+	if !filepath.IsAbs(root) {
+		root = filepath.Join(db.Path(), root)
+	}
+	dbDir := filepath.Join(db.Path(), ".notmuch")
+	start := time.Now()
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.IsDir() {
+			return err
+		}
+		if path == dbDir || isMaildirTmp(path) {
+			return filepath.SkipDir
+		}
+		return db.reconcileDir(path, fi, start, opts, &report)
+	})
+	return report, err
+}
+
+// Store the current on-disk mtime of root and every directory below it, as a
+// full scan does when it is done, and return the number of directories whose
+// stored mtime changed. Relative paths are taken relative to the database
+// root. All mtimes are stored in a single atomic section.
+//
+// As in Reconcile, an mtime from the current second is not stored, since the
+// directory could still change within that second.
+func (db *Database) UpdateDirectoryMTimes(root string) (n int, err error) {
+	if err := db.useWritable("UpdateDirectoryMTimes"); err != nil {
+		return 0, err
+	}
+	if !filepath.IsAbs(root) {
+		root = filepath.Join(db.Path(), root)
+	}
+	if st := status(C.notmuch_database_begin_atomic(db.db)); st != statusSuccess {
+		return 0, db.statusError(st)
+	}
+	defer func() {
+		st := status(C.notmuch_database_end_atomic(db.db))
+		if err == nil {
+			err = db.statusError(st)
+		}
+	}()
+	dbDir := filepath.Join(db.Path(), ".notmuch")
+	now := time.Now().Unix()
+	err = filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.IsDir() {
+			return err
+		}
+		if path == dbDir || isMaildirTmp(path) {
+			return filepath.SkipDir
+		}
+		mtime := fi.ModTime()
+		if mtime.Unix() >= now {
+			return nil
+		}
+		dir, err := db.Directory(path)
+		if err != nil {
+			return err
+		}
+		if dir.MTime().Unix() == mtime.Unix() {
+			return nil
+		}
+		if err := dir.SetMTime(mtime); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
+
+func isMaildirTmp(path string) bool {
+	if filepath.Base(path) != "tmp" {
+		return false
+	}
+	parent := filepath.Dir(path)
+	for _, sub := range []string{"cur", "new"} {
+		if fi, err := os.Stat(filepath.Join(parent, sub)); err != nil || !fi.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+func (db *Database) reconcileDir(path string, fi os.FileInfo, start time.Time, opts ReconcileOpts, report *ReconcileReport) error {
+	dir, err := db.Directory(path)
+	if err != nil {
+		return err
+	}
+	mtime := fi.ModTime()
+	if dir.MTime().Unix() == mtime.Unix() {
+		return nil
+	}
+
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	files := make(map[string]bool)
+	dirs := make(map[string]bool)
+	for _, e := range entries {
+		if e.Mode().IsRegular() {
+			files[e.Name()] = true
+		} else if e.IsDir() {
+			dirs[e.Name()] = true
+		}
+	}
+
+	indexed := make(map[string]bool)
+	for _, name := range dir.ChildFiles() {
+		indexed[name] = true
+		if files[name] {
+			continue
+		}
+		if _, err = db.RemoveMessage(filepath.Join(path, name)); err != nil {
+			return err
+		}
+		report.Removed++
+	}
+	for _, name := range dir.ChildDirectories() {
+		if !dirs[name] {
+			if err = db.removeDirectory(filepath.Join(path, name), report); err != nil {
+				return err
+			}
+		}
+	}
+	for name := range files {
+		if indexed[name] {
+			continue
+		}
+		res, err := db.IndexFileResult(filepath.Join(path, name))
+		var e Error
+		if errors.As(err, &e) && e.Code == int(statusFileNotEmail) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if res.Merged {
+			report.Updated++
+		} else {
+			report.Added++
+		}
+		if opts.SyncMaildirFlags {
+			err = res.Message.AddTagsFromFilename()
+		}
+		res.Message.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Like "notmuch new", don't store an mtime from the second the scan
+	// started in: the directory could still change within that second
+	// without its mtime changing.
+	if mtime.Unix() < start.Unix() {
+		return dir.SetMTime(mtime)
+	}
+	return nil
+}
+
+// Remove the filenames of all files in the directory 'path' and its
+// subdirectories from the index, along with the directory documents.
+func (db *Database) removeDirectory(path string, report *ReconcileReport) error {
+	dir, err := db.Directory(path)
+	if err != nil || dir == nil {
+		return err
+	}
+	for _, name := range dir.ChildFiles() {
+		if _, err = db.RemoveMessage(filepath.Join(path, name)); err != nil {
+			return err
+		}
+		report.Removed++
+	}
+	for _, name := range dir.ChildDirectories() {
+		if err = db.removeDirectory(filepath.Join(path, name), report); err != nil {
+			return err
+		}
+	}
+	return dir.Delete()
+}
+
+// Delete the documents of indexed directories that have neither files nor
+// subdirectories left, for example after their messages were removed, and
+// return the number deleted. Directories left empty by pruning their
+// subdirectories are deleted as well. The root directory is always kept.
+func (db *Database) PruneEmptyDirectories() (int, error) {
+	if err := db.use(); err != nil {
+		return 0, err
+	}
+	var n int
+	_, err := db.pruneDirectory(db.Path(), true, &n)
+	return n, err
+}
+
+// Prune the empty directories below 'path', and 'path' itself unless it is the
+// root, reporting whether it was deleted.
+func (db *Database) pruneDirectory(path string, root bool, n *int) (bool, error) {
+	dir, err := db.Directory(path)
+	if err != nil || dir == nil {
+		return false, err
+	}
+	left := 0
+	for _, name := range dir.ChildDirectories() {
+		pruned, err := db.pruneDirectory(filepath.Join(path, name), false, n)
+		if err != nil {
+			return false, err
+		}
+		if !pruned {
+			left++
+		}
+	}
+	if root || left > 0 || len(dir.ChildFiles()) > 0 {
+		return false, nil
+	}
+	if err := dir.Delete(); err != nil {
+		return false, err
+	}
+	*n++
+	return true, nil
+}
+
+// Count the messages matching the given notmuch search terms. An empty query
+// counts all messages.
+func (db *Database) Count(query string) (int, error) {
+	return db.countMessages(query)
+}
+
+// Count the messages in the thread with the given ID, returning both their
+// total number and the number that a search for the thread matches, which
+// leaves out the messages with one of the tags in "search.exclude_tags".
+func (db *Database) ThreadSize(threadID string) (total int, matched int, err error) {
+	query := "thread:" + quoteTerm(threadID)
+	if total, err = db.countMessages(query); err != nil {
+		return 0, 0, err
+	}
+	excluded, err := db.GetConfigValues("search.exclude_tags")
+	if err != nil || len(excluded) == 0 {
+		return total, total, err
+	}
+	for _, tag := range excluded {
+		query += " and not tag:" + quoteTerm(tag)
+	}
+	if matched, err = db.countMessages(query); err != nil {
+		return 0, 0, err
+	}
+	return total, matched, nil
+}
+
+// Count the messages matching the given notmuch search terms, reusing the
+// result of an earlier call with the same query for up to 'ttl', as long as
+// the database revision has not changed since.
+//
+// CachedCount may be called from several goroutines at once; the calls are
+// serialized.
+func (db *Database) CachedCount(query string, ttl time.Duration) (int, error) {
+	db.countMu.Lock()
+	defer db.countMu.Unlock()
+	if err := db.use(); err != nil {
+		return 0, err
+	}
+	rev := db.Revision()
+	now := time.Now()
+	if c, ok := db.counts[query]; ok && c.rev == rev && now.Before(c.expires) {
+		return c.count, nil
+	}
+	count, err := db.countMessages(query)
+	if err != nil {
+		return 0, err
+	}
+	if db.counts == nil {
+		db.counts = make(map[string]cachedCount)
+	}
+	db.counts[query] = cachedCount{count: count, rev: rev, expires: now.Add(ttl)}
+	return count, nil
+}
+
+// Create a query for the given notmuch search terms. The caller must destroy
+// it.
+//
+// An empty or blank query matches every message, the same as "*", which
+// libnotmuch answers straight from the document list without parsing.
+func (db *Database) newQuery(query string) (*C.notmuch_query_t, error) {
+	if err := db.use(); err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(query) == "" {
+		query = "*"
+	}
+	cQuery := C.CString(query)
+	q := C.notmuch_query_create(db.db, cQuery)
+	C.free(unsafe.Pointer(cQuery))
+	if q == nil {
+		return nil, statusToError(statusOutOfMemory)
+	}
+	return q, nil
+}
+
+// Call fn for each message matching the given notmuch search terms, in no
+// particular order. Iteration stops at the first error returned by fn.
+//
+// The messages passed to fn are destroyed once it returns and must not be kept.
+// In exchange, iterating is cheap: a single Message is reused for all results,
+// and none of them get a finalizer.
+func (db *Database) searchMessages(query string, fn func(*Message) error) error {
+	q, err := db.newQuery(query)
+	if err != nil {
+		return err
+	}
+	defer C.notmuch_query_destroy(q)
+	C.notmuch_query_set_sort(q, C.NOTMUCH_SORT_UNSORTED)
+	var cMsgs *C.notmuch_messages_t
+	st := status(C.notmuch_query_search_messages(q, &cMsgs))
+	if st != statusSuccess {
+		return db.queryError(query, st)
+	}
+	msg := Message{db: db, owner: db.db}
+	for v := C.notmuch_messages_valid(cMsgs); v != 0; v = C.notmuch_messages_valid(cMsgs) {
+		msg.msg = C.notmuch_messages_get(cMsgs)
+		err := fn(&msg)
+		if msg.msg != nil {
+			C.notmuch_message_destroy(msg.msg)
+			msg.msg = nil
+		}
+		if err != nil {
+			return err
+		}
+		C.notmuch_messages_move_to_next(cMsgs)
+	}
+	return nil
+}
+
+// Count the messages matching the given notmuch search terms.
+func (db *Database) countMessages(query string) (int, error) {
+	q, err := db.newQuery(query)
+	if err != nil {
+		return 0, err
+	}
+	defer C.notmuch_query_destroy(q)
+	var count C.uint
+	st := status(C.notmuch_query_count_messages(q, &count))
+	if st != statusSuccess {
+		return 0, db.queryError(query, st)
+	}
+	return int(count), nil
+}
+
+// Wrap a failure status from running a query with the query string and, if
+// libnotmuch recorded one, its description of the problem. Query syntax errors
+// only surface this way when the query is first run.
+func (db *Database) queryError(query string, st status) error {
+	err := Error{Code: int(st), Op: "query", Path: query}
+	if detail := C.notmuch_database_status_string(db.db); detail != nil {
+		err.Detail = strings.TrimSpace(C.GoString(detail))
+	}
+	return err
+}
+
+// Quote s as a single phrase for use in a notmuch search term, e.g. id:"...".
+func quoteTerm(s string) string {
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+}
+
+// A search query on a database.
+//
+// A query can be counted and searched any number of times, in any order; each
+// SearchMessages call starts a new iterator from the first result. The
+// iterators stay with the query until it is closed, so close them when done
+// with them if the query is used for long.
+//
+// A query and everything obtained from it, its Messages iterators and the
+// messages they return, are freed by Close. A query that is garbage collected
+// without being closed is freed at the next call on the database; building
+// with the notmuch_leakcheck tag logs a warning when that happens.
+type Query struct {
+	q     *C.notmuch_query_t
+	db    *Database
+	owner *C.notmuch_database_t
+	query string
+}
+
+// Called with a description of each object the garbage collector freed
+// without it being closed, if set. See leakcheck.go.
+var reportLeak func(what string)
+
+// Create a query for the given notmuch search terms, leaving out messages with
+// the tags listed in the "search.exclude_tags" configuration key like the
+// notmuch command line tools do. An empty query matches all messages.
+//
+// The search helpers of Database, such as MessagesInFolder, use queries
+// created by NewQuery.
+func (db *Database) NewQuery(query string) (*Query, error) {
+	q, err := db.NewQueryRaw(query)
+	if err != nil {
+		return nil, err
+	}
+	if err := q.ApplyConfiguredExcludes(db); err != nil {
+		q.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+// Create a query for the given notmuch search terms like NewQuery, but
+// without excluding any tags.
+func (db *Database) NewQueryRaw(query string) (*Query, error) {
+	q, err := db.newQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	qry := Query{q: q, db: db, owner: db.db, query: query}
+	runtime.SetFinalizer(&qry, finalizeQuery)
+	return &qry, nil
+}
+
+func finalizeQuery(q *Query) {
+	if reportLeak != nil {
+		reportLeak(fmt.Sprintf("query %q", q.query))
+	}
+	cQuery := q.q
+	q.db.release(func() { C.notmuch_query_destroy(cQuery) })
+}
+
+// Free the query, along with its Messages iterators and the messages they
+// returned, which must not be used any more.
+//
+// Closing an already closed query does nothing. The methods of a closed query
+// return ErrQueryClosed, and ErrDatabaseClosed once the database was closed.
+func (q *Query) Close() {
+	if q.q == nil {
+		return
+	}
+	runtime.SetFinalizer(q, nil)
+	// A closed database already freed its queries.
+	if q.db.db != nil {
+		C.notmuch_query_destroy(q.q)
+	}
+	q.q = nil
+}
+
+// Check that the query is still usable, like Message.check.
+func (q *Query) check() error {
+	if q.q == nil {
+		return ErrQueryClosed
+	}
+	if err := q.db.use(); err != nil {
+		return err
+	}
+	if q.db.db != q.owner {
+		return ErrDatabaseClosed
+	}
+	return nil
+}
+
+// Get the search terms of the query.
+func (q *Query) String() string {
+	return q.query
+}
+
+// Leave messages with the given tag out of the results of the query, unless
+// the query terms themselves mention the tag, as in notmuch.
+func (q *Query) AddTagExclude(tag string) error {
+	if err := q.check(); err != nil {
+		return err
+	}
+	cTag := C.CString(tag)
+	st := status(C.notmuch_query_add_tag_exclude(q.q, cTag))
+	C.free(unsafe.Pointer(cTag))
+	if st == statusIgnored {
+		return nil
+	}
+	return q.db.statusError(st)
+}
+
+// Exclude the tags listed in the "search.exclude_tags" configuration key of
+// db, which must be the database of the query, like the notmuch command line
+// tools do for every search.
+func (q *Query) ApplyConfiguredExcludes(db *Database) error {
+	if db != q.db {
+		return errors.New("notmuch: query belongs to another database")
+	}
+	tags, err := db.GetConfigValues("search.exclude_tags")
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if err := q.AddTagExclude(tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Count the messages matching the query.
+func (q *Query) CountMessages() (int, error) {
+	if err := q.check(); err != nil {
+		return 0, err
+	}
+	var count C.uint
+	st := status(C.notmuch_query_count_messages(q.q, &count))
+	if st != statusSuccess {
+		return 0, q.db.queryError(q.query, st)
+	}
+	return int(count), nil
+}
+
+// Search for the messages matching the query, newest first.
+func (q *Query) SearchMessages() (*Messages, error) {
+	if err := q.check(); err != nil {
+		return nil, err
+	}
+	var cMsgs *C.notmuch_messages_t
+	st := status(C.notmuch_query_search_messages(q.q, &cMsgs))
+	if st != statusSuccess {
+		return nil, q.db.queryError(q.query, st)
+	}
+	return &Messages{msgs: cMsgs, query: q}, nil
+}
+
+// An iterator over the messages found by Query.SearchMessages.
+//
+// The iterator and the messages it returns belong to the query and are freed
+// when it is closed.
+type Messages struct {
+	msgs  *C.notmuch_messages_t
+	query *Query
+
+	// Set if the query was created just for these results, so that Close
+	// frees it as well.
+	ownQuery bool
+}
+
+// Return the next message, or nil once all messages were returned.
+//
+// The message stays valid until it is closed, or until the iterator or the
+// query is. Use Message.Clone to keep it beyond them.
+func (ms *Messages) Next() (*Message, error) {
+	if ms.msgs == nil {
+		return nil, ErrQueryClosed
+	}
+	if err := ms.query.check(); err != nil {
+		return nil, err
+	}
+	if C.notmuch_messages_valid(ms.msgs) == 0 {
+		return nil, nil
+	}
+	msg := &Message{
+		msg:   C.notmuch_messages_get(ms.msgs),
+		db:    ms.query.db,
+		owner: ms.query.owner,
+		iter:  ms,
+	}
+	C.notmuch_messages_move_to_next(ms.msgs)
+	return msg, nil
+}
+
+// Free the iterator and the messages it returned before the query is closed.
+// Results returned by the search helpers of Database, such as
+// MessagesInFolder, have a query of their own, which is freed as well.
+// Closing an already closed iterator does nothing.
+func (ms *Messages) Close() {
+	if ms.msgs == nil {
+		return
+	}
+	if ms.ownQuery {
+		ms.query.Close()
+	} else if !ms.closed() && ms.query.db.db != nil {
+		C.notmuch_messages_destroy(ms.msgs)
+	}
+	ms.msgs = nil
+}
+
+// Search for the messages matching query with a query of their own, see
+// Messages.Close.
+func (db *Database) search(query string) (*Messages, error) {
+	q, err := db.NewQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	ms, err := q.SearchMessages()
+	if err != nil {
+		q.Close()
+		return nil, err
+	}
+	ms.ownQuery = true
+	return ms, nil
+}
+
+// Search for the messages matching query and count them, using one query for
+// both. The results own the query, and closing them frees it.
+//
+// The count is taken before searching, so it can differ from the number of
+// messages returned if the database is changed in between.
+func (db *Database) SearchWithCount(query string) (*Messages, int, error) {
+	q, err := db.NewQuery(query)
+	if err != nil {
+		return nil, 0, err
+	}
+	n, err := q.CountMessages()
+	if err != nil {
+		q.Close()
+		return nil, 0, err
+	}
+	ms, err := q.SearchMessages()
+	if err != nil {
+		q.Close()
+		return nil, 0, err
+	}
+	ms.ownQuery = true
+	return ms, n, nil
+}
+
+// Search for the messages dated from start to end, both inclusive, using the
+// date:@<start>..@<end> syntax of notmuch with timestamps in seconds. A zero
+// start or end leaves that side of the range open.
+func (db *Database) MessagesBetween(start, end time.Time) (*Messages, error) {
+	if start.IsZero() && end.IsZero() {
+		return db.search("*")
+	}
+	var from, to string
+	if !start.IsZero() {
+		from = "@" + strconv.FormatInt(start.Unix(), 10)
+	}
+	if !end.IsZero() {
+		to = "@" + strconv.FormatInt(end.Unix(), 10)
+	}
+	return db.search("date:" + from + ".." + to)
+}
+
+// Search for the messages matching all of the given queries. Each query is
+// parenthesized before they are joined with "and", and empty queries are
+// skipped. Without any non-empty query, all messages match.
+func (db *Database) SearchAnd(queries ...string) (*Messages, error) {
+	return db.search(joinQueries(queries, " and "))
+}
+
+// Search for the messages matching any of the given queries, which are
+// combined like in SearchAnd but joined with "or".
+func (db *Database) SearchOr(queries ...string) (*Messages, error) {
+	return db.search(joinQueries(queries, " or "))
+}
+
+func joinQueries(queries []string, op string) string {
+	var parts []string
+	for _, q := range queries {
+		if strings.TrimSpace(q) != "" {
+			parts = append(parts, "("+q+")")
+		}
+	}
+	return strings.Join(parts, op)
+}
+
+// Search for the messages with a file in the maildir 'folder', relative to the
+// database root, using notmuch's folder: term.
+//
+// A folder is a maildir: files in its cur/ and new/ directories are found, but
+// not those in its subfolders. Pass "" for the maildir at the root itself.
+// Close the results when done with them.
+func (db *Database) MessagesInFolder(folder string) (*Messages, error) {
+	folder = filepath.ToSlash(filepath.Clean(folder))
+	if folder == "." {
+		folder = ""
+	}
+	return db.search("folder:" + quoteTerm(folder))
+}
+
+// Search for the messages with a file anywhere below the directory 'path',
+// relative to the database root, using notmuch's path: term.
+//
+// Unlike MessagesInFolder, this matches plain directories, including cur/ and
+// new/ themselves, and everything below them. Close the results when done
+// with them.
+func (db *Database) MessagesUnderPath(path string) (*Messages, error) {
+	path = filepath.ToSlash(filepath.Clean(path))
+	if path == "." {
+		return db.search("*")
+	}
+	return db.search("path:" + quoteTerm(path+"/**"))
+}
+
+// Report whether the iterator was freed, by itself or with its query.
+func (ms *Messages) closed() bool {
+	return ms.msgs == nil || ms.query.q == nil
+}
+
 type Message struct {
 	msg *C.notmuch_message_t
+	db  *Database
+	log *ChangeLog
+
+	// The database handle the message belongs to. It differs from db.db
+	// once CompactInPlace replaced the handle.
+	owner *C.notmuch_database_t
+
+	// The search results the message was returned from, which own it, if
+	// any.
+	iter *Messages
+}
+
+// Check that the message is still usable: neither it nor the database handle
+// it belongs to has been closed, which would have freed it.
+func (m *Message) check() error {
+	if m.msg == nil || m.iter != nil && m.iter.closed() {
+		return ErrMessageClosed
+	}
+	if m.db.db == nil || m.db.db != m.owner {
+		return ErrDatabaseClosed
+	}
+	return nil
 }
 
 func finalizeMessage(msg *Message) {
-	C.notmuch_message_destroy(msg.msg)
+	cMsg := msg.msg
+	msg.db.release(func() { C.notmuch_message_destroy(cMsg) })
+}
+
+// Free the resources held by the message without waiting for it to be garbage
+// collected.
+//
+// Closing an already closed message does nothing. Methods returning an error
+// return ErrMessageClosed after Close, and ErrDatabaseClosed once the database
+// was closed; the others return zero values in both cases.
+func (m *Message) Close() {
+	if m.msg == nil {
+		return
+	}
+	runtime.SetFinalizer(m, nil)
+	// A closed database or query already freed its messages.
+	if m.db.db != nil && (m.iter == nil || !m.iter.closed()) {
+		C.notmuch_message_destroy(m.msg)
+	}
+	m.msg = nil
+}
+
+// Get a new handle to the message, looked up again by ID in db.
+//
+// Messages handed out while iterating a search are owned by its query and are
+// freed with it. The clone is owned by the database instead and stays valid
+// until it is closed or the database is.
+func (m *Message) Clone(db *Database) (*Message, error) {
+	if err := m.check(); err != nil {
+		return nil, err
+	}
+	return db.FindMessage(m.ID())
+}
+
+// Get the message ID.
+func (m *Message) ID() string {
+	if m.check() != nil {
+		return ""
+	}
+	id := C.notmuch_message_get_message_id(m.msg)
+	return C.GoString(id)
+}
+
+// Get the ID of the thread the message belongs to.
+func (m *Message) ThreadID() string {
+	if m.check() != nil {
+		return ""
+	}
+	return C.GoString(C.notmuch_message_get_thread_id(m.msg))
 }
 
-// Get the message ID.
-func (m *Message) ID() string {
-	id := C.notmuch_message_get_message_id(m.msg)
-	return C.GoString(id)
+// Get the database revision at which the message was last modified.
+//
+// libnotmuch has no direct accessor for this, so it is found by searching for
+// the highest revision N for which "id:<id> and lastmod:N..<current>" still
+// matches the message.
+func (m *Message) LastModified() (uint64, error) {
+	if err := m.check(); err != nil {
+		return 0, err
+	}
+	if err := m.db.use(); err != nil {
+		return 0, err
+	}
+	rev := m.db.Revision()
+	id := quoteTerm(m.ID())
+	lo, hi := uint64(0), rev
+	for lo < hi {
+		mid := lo + (hi-lo+1)/2
+		n, err := m.db.countMessages(fmt.Sprintf("id:%s and lastmod:%d..%d", id, mid, rev))
+		if err != nil {
+			return 0, err
+		}
+		if n > 0 {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return lo, nil
 }
 
 // Get a filename for the message.
 func (m *Message) FileName() string {
+	if m.check() != nil {
+		return ""
+	}
 	path := C.notmuch_message_get_filename(m.msg)
 	return C.GoString(path)
 }
 
+// Get the number of filenames for the message.
+func (m *Message) CountFiles() int {
+	if m.check() != nil {
+		return 0
+	}
+	return int(C.notmuch_message_count_files(m.msg))
+}
+
+// Get all filenames for the message.
+func (m *Message) FileNames() []string {
+	if m.check() != nil {
+		return nil
+	}
+	return filenamesToSlice(C.notmuch_message_get_filenames(m.msg))
+}
+
+// Collect the names from a filenames iterator and destroy it.
+func filenamesToSlice(cNames *C.notmuch_filenames_t) (names []string) {
+	if cNames == nil {
+		return
+	}
+	for v := C.notmuch_filenames_valid(cNames); v != 0; v = C.notmuch_filenames_valid(cNames) {
+		names = append(names, C.GoString(C.notmuch_filenames_get(cNames)))
+		C.notmuch_filenames_move_to_next(cNames)
+	}
+	C.notmuch_filenames_destroy(cNames)
+	return
+}
+
+// Call fn with the primary filename of the message and, as long as fn fails
+// because the file does not exist, with each of its other filenames. Returns
+// the last error from fn.
+func (m *Message) withExistingFile(fn func(name string) error) error {
+	primary := m.FileName()
+	err := fn(primary)
+	if !os.IsNotExist(err) {
+		return err
+	}
+	for _, name := range m.FileNames() {
+		if name == primary {
+			continue
+		}
+		if err = fn(name); !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// Open the message file for reading.
+//
+// notmuch only stores the index, so this is the way to get at the full raw
+// message. If the primary filename no longer exists, the other filenames of
+// the message are tried in turn.
+func (m *Message) RawReader() (io.ReadCloser, error) {
+	if err := m.check(); err != nil {
+		return nil, err
+	}
+	var f *os.File
+	err := m.withExistingFile(func(name string) (err error) {
+		f, err = os.Open(name)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Report whether the files of the message and of other, as opened by
+// RawReader, are byte for byte identical. The other message may belong to
+// another database, such as a replica of this one.
+//
+// The files are compared block by block, without reading either one into
+// memory at once.
+func (m *Message) SameContentAs(other *Message) (bool, error) {
+	a, err := m.RawReader()
+	if err != nil {
+		return false, err
+	}
+	defer a.Close()
+	b, err := other.RawReader()
+	if err != nil {
+		return false, err
+	}
+	defer b.Close()
+	bufA, bufB := make([]byte, 32*1024), make([]byte, 32*1024)
+	for {
+		nA, errA := io.ReadFull(a, bufA)
+		nB, errB := io.ReadFull(b, bufB)
+		if !bytes.Equal(bufA[:nA], bufB[:nB]) {
+			return false, nil
+		}
+		endA := errA == io.EOF || errA == io.ErrUnexpectedEOF
+		endB := errB == io.EOF || errB == io.ErrUnexpectedEOF
+		switch {
+		case errA != nil && !endA:
+			return false, errA
+		case errB != nil && !endB:
+			return false, errB
+		case endA || endB:
+			return endA == endB, nil
+		}
+	}
+}
+
+// Get the size in bytes of the message file.
+//
+// notmuch does not store message sizes, so this stats the primary filename,
+// falling back to the other filenames if it no longer exists.
+func (m *Message) Size() (int64, error) {
+	if err := m.check(); err != nil {
+		return 0, err
+	}
+	var size int64
+	err := m.withExistingFile(func(name string) error {
+		fi, err := os.Stat(name)
+		if err == nil {
+			size = fi.Size()
+		}
+		return err
+	})
+	return size, err
+}
+
+// Get the date of the message, as given by its Date header.
+func (m *Message) Date() time.Time {
+	if m.check() != nil {
+		return time.Time{}
+	}
+	return time.Unix(int64(C.notmuch_message_get_date(m.msg)), 0)
+}
+
+// Get the value of the specified header from the message.
+//
+// The header name is case insensitive. RFC 2047 encoded words in the value are
+// decoded, and invalid UTF-8 sequences are replaced with U+FFFD. Returns an
+// empty string if the message does not contain the header or it could not be
+// read.
+func (m *Message) Header(name string) string {
+	return decodeHeader(m.rawHeader(name))
+}
+
+func (m *Message) rawHeader(name string) string {
+	if m.check() != nil {
+		return ""
+	}
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+	return C.GoString(C.notmuch_message_get_header(m.msg, cName))
+}
+
+// The headers returned by Message.Headers.
+var defaultHeaders = []string{"From", "To", "Cc", "Subject", "Date", "Message-Id", "In-Reply-To", "References"}
+
+// Get the common headers of the message, decoded as by Header: From, To, Cc,
+// Subject, Date, Message-Id, In-Reply-To and References. Headers the message
+// does not have are left out.
+func (m *Message) Headers() (map[string]string, error) {
+	return m.HeadersFor(defaultHeaders)
+}
+
+// Get the given headers of the message, decoded as by Header and keyed by the
+// names as passed. Headers the message does not have are left out.
+func (m *Message) HeadersFor(names []string) (map[string]string, error) {
+	if err := m.check(); err != nil {
+		return nil, err
+	}
+	headers := make(map[string]string, len(names))
+	for _, name := range names {
+		if value := m.rawHeader(name); value != "" {
+			headers[name] = decodeHeader(value)
+		}
+	}
+	return headers, nil
+}
+
+// Check whether the message has the given header, even if its value is empty.
+//
+// libnotmuch returns an empty string both for absent and for empty headers, so
+// when Header() is empty the header block of the message file is parsed to
+// tell the two apart. Returns false if the file cannot be read.
+func (m *Message) HasHeader(name string) bool {
+	if m.Header(name) != "" {
+		return true
+	}
+	h, err := m.RawHeaders()
+	if err != nil {
+		return false
+	}
+	_, ok := h[textproto.CanonicalMIMEHeaderKey(name)]
+	return ok
+}
+
+// Get all headers of the message, parsed from the header block of the message
+// file, including those notmuch does not index such as Received. The values
+// are returned as they appear in the file, without decoding. The file is
+// opened like RawReader does.
+func (m *Message) RawHeaders() (textproto.MIMEHeader, error) {
+	r, err := m.RawReader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return textproto.NewReader(bufio.NewReader(r)).ReadMIMEHeader()
+}
+
+var headerDecoder mime.WordDecoder
+
+// Decode the encoded words in a header value and make sure the result is valid
+// UTF-8. Values that fail to decode are only sanitized.
+func decodeHeader(value string) string {
+	if decoded, err := headerDecoder.DecodeHeader(value); err == nil {
+		value = decoded
+	}
+	return strings.ToValidUTF8(value, "\uFFFD")
+}
+
+// Get the message subject. If 'stripPrefixes' is set, any leading reply and
+// forward markers ("Re:", "Fwd:", "Fw:") are removed.
+func (m *Message) Subject(stripPrefixes bool) string {
+	subject := m.Header("Subject")
+	if stripPrefixes {
+		subject = stripSubjectPrefixes(subject)
+	}
+	return subject
+}
+
+var addressParser = mail.AddressParser{WordDecoder: &headerDecoder}
+
+// Parse the From header of the message into an address.
+//
+// Encoded words in the display name are decoded as for Header().
+func (m *Message) From() (*mail.Address, error) {
+	if err := m.check(); err != nil {
+		return nil, err
+	}
+	addr, err := addressParser.Parse(m.rawHeader("From"))
+	if err != nil {
+		return nil, err
+	}
+	addr.Name = strings.ToValidUTF8(addr.Name, "\uFFFD")
+	return addr, nil
+}
+
+// Parse the To header of the message into a list of addresses.
+//
+// Encoded words in display names are decoded as for Header(). Returns nil if
+// the message has no To header.
+func (m *Message) To() ([]*mail.Address, error) {
+	if err := m.check(); err != nil {
+		return nil, err
+	}
+	to := m.rawHeader("To")
+	if to == "" {
+		return nil, nil
+	}
+	addrs, err := addressParser.ParseList(to)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		addr.Name = strings.ToValidUTF8(addr.Name, "\uFFFD")
+	}
+	return addrs, nil
+}
+
+var subjectPrefixes = []string{"re:", "fwd:", "fw:"}
+
+func stripSubjectPrefixes(subject string) string {
+	for {
+		subject = strings.TrimLeft(subject, " \t")
+		lower := strings.ToLower(subject)
+		stripped := false
+		for _, p := range subjectPrefixes {
+			if strings.HasPrefix(lower, p) {
+				subject = subject[len(p):]
+				stripped = true
+				break
+			}
+		}
+		if !stripped {
+			return subject
+		}
+	}
+}
+
+// Get a plain text preview of the message body of at most maxLen characters,
+// or of any length if maxLen is not positive.
+//
+// The preview is taken from the first text/plain part of the message, which
+// for multipart/alternative messages is preferred over the other variants.
+// Quoted lines, reply attributions and the signature are left out, and the
+// remaining text is joined into a single line. Messages without a text/plain
+// part have an empty preview.
+func (m *Message) Snippet(maxLen int) (string, error) {
+	r, err := m.RawReader()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return "", err
+	}
+	text, err := plainText(textproto.MIMEHeader(msg.Header), msg.Body)
+	if err != nil {
+		return "", err
+	}
+	var words []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "-- " {
+			break
+		}
+		if strings.HasPrefix(line, ">") || strings.HasSuffix(strings.TrimSpace(line), "wrote:") {
+			continue
+		}
+		words = append(words, strings.Fields(line)...)
+	}
+	snippet := []rune(strings.ToValidUTF8(strings.Join(words, " "), "\uFFFD"))
+	if maxLen > 0 && len(snippet) > maxLen {
+		snippet = snippet[:maxLen]
+	}
+	return string(snippet), nil
+}
+
+// Find the first text/plain part of a message or message part and return its
+// decoded content. It returns an empty string if there is none.
+func plainText(header textproto.MIMEHeader, body io.Reader) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		// RFC 2045 defaults to plain text.
+		mediaType = "text/plain"
+	}
+	switch {
+	case mediaType == "text/plain":
+		switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+		case "quoted-printable":
+			body = quotedprintable.NewReader(body)
+		case "base64":
+			body = base64.NewDecoder(base64.StdEncoding, body)
+		}
+		data, err := ioutil.ReadAll(body)
+		return string(data), err
+	case strings.HasPrefix(mediaType, "multipart/"):
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return "", nil
+			}
+			if err != nil {
+				return "", err
+			}
+			text, err := plainText(part.Header, part)
+			if text != "" || err != nil {
+				return text, err
+			}
+		}
+	}
+	return "", nil
+}
+
 // Return a list of tags for the message.
 func (m *Message) Tags() (tags []string) {
+	if m.check() != nil {
+		return
+	}
+	iterateTags(C.notmuch_message_get_tags(m.msg), func(tag string) error {
+		tags = append(tags, tag)
+		return nil
+	})
+	return
+}
+
+// Get the directory object for the directory containing the message's primary
+// filename.
+func (m *Message) Directory(db *Database) (*Directory, error) {
+	if err := m.check(); err != nil {
+		return nil, err
+	}
+	rel, err := filepath.Rel(db.Path(), filepath.Dir(m.FileName()))
+	if err != nil {
+		return nil, err
+	}
+	if rel == "." {
+		rel = ""
+	}
+	return db.Directory(rel)
+}
+
+// Check whether the message has the given tag.
+//
+// Unlike searching the result of Tags(), this does not build the tag list and
+// stops at the first match.
+func (m *Message) HasTag(tag string) bool {
+	if m.check() != nil {
+		return false
+	}
 	cTags := C.notmuch_message_get_tags(m.msg)
 	if cTags == nil {
-		return
+		return false
 	}
+	defer C.notmuch_tags_destroy(cTags)
+	cTag := C.CString(tag)
+	defer C.free(unsafe.Pointer(cTag))
 	for v := C.notmuch_tags_valid(cTags); v != 0; v = C.notmuch_tags_valid(cTags) {
-		s := C.notmuch_tags_get(cTags)
-		tags = append(tags, C.GoString(s))
+		if C.strcmp(C.notmuch_tags_get(cTags), cTag) == 0 {
+			return true
+		}
 		C.notmuch_tags_move_to_next(cTags)
 	}
-	C.notmuch_tags_destroy(cTags)
-	return
+	return false
 }
 
 // Add a tag to the message.
 func (m *Message) AddTag(tag string) error {
+	if err := m.check(); err != nil {
+		return err
+	}
+	had := m.log != nil && m.HasTag(tag)
 	cTag := C.CString(tag)
 	defer C.free(unsafe.Pointer(cTag))
-	return statusToError(status(C.notmuch_message_add_tag(m.msg, cTag)))
+	if err := m.db.statusError(status(C.notmuch_message_add_tag(m.msg, cTag))); err != nil {
+		return err
+	}
+	if m.log != nil && !had {
+		m.log.record(tag, true)
+	}
+	return nil
 }
 
 // Remove a tag from the message.
 func (m *Message) RemoveTag(tag string) error {
+	if err := m.check(); err != nil {
+		return err
+	}
+	had := m.log != nil && m.HasTag(tag)
 	cTag := C.CString(tag)
 	defer C.free(unsafe.Pointer(cTag))
-	return statusToError(status(C.notmuch_message_remove_tag(m.msg, cTag)))
+	if err := m.db.statusError(status(C.notmuch_message_remove_tag(m.msg, cTag))); err != nil {
+		return err
+	}
+	if had {
+		m.log.record(tag, false)
+	}
+	return nil
 }
 
 // Remove all tags from the message.
 func (m *Message) RemoveAllTags() error {
-	return statusToError(status(C.notmuch_message_remove_all_tags(m.msg)))
+	if err := m.check(); err != nil {
+		return err
+	}
+	var old []string
+	if m.log != nil {
+		old = m.Tags()
+	}
+	if err := m.db.statusError(status(C.notmuch_message_remove_all_tags(m.msg))); err != nil {
+		return err
+	}
+	for _, tag := range old {
+		m.log.record(tag, false)
+	}
+	return nil
+}
+
+// Take a snapshot of the tags of the message, to be passed to RestoreTags
+// later.
+func (m *Message) SnapshotTags() []string {
+	return m.Tags()
+}
+
+// Set the tags of the message back to a snapshot taken with SnapshotTags,
+// undoing any changes made since. The tags are replaced while the message is
+// frozen, so the change is written all at once.
+func (m *Message) RestoreTags(snapshot []string) error {
+	if err := m.check(); err != nil {
+		return err
+	}
+	return m.setTags(snapshot)
+}
+
+// A record of the tags added to and removed from a message, see
+// Message.SetChangeLog.
+//
+// Only actual changes are recorded: adding a tag the message already has is
+// not. A tag that is added and then removed again, or the other way round,
+// drops out of the log, so it always holds the net change.
+type ChangeLog struct {
+	Added   []string
+	Removed []string
+}
+
+func (l *ChangeLog) record(tag string, added bool) {
+	from, to := &l.Removed, &l.Added
+	if !added {
+		from, to = to, from
+	}
+	for i, t := range *from {
+		if t == tag {
+			*from = append((*from)[:i], (*from)[i+1:]...)
+			return
+		}
+	}
+	*to = append(*to, tag)
+}
+
+// Record the tag changes made through this message handle in log, including
+// those made between Freeze and Thaw. Pass nil to stop recording.
+func (m *Message) SetChangeLog(log *ChangeLog) {
+	m.log = log
+}
+
+// The message property recording when a file of the message was last indexed,
+// in seconds since the Unix epoch.
+const indexedAtProperty = "nmsync.indexed-at"
+
+// Get the time a file of the message was last indexed or the message was
+// reindexed by ReindexIfChanged. The boolean is false for messages indexed
+// before this was recorded, or by other programs.
+func (m *Message) IndexedAt() (time.Time, bool, error) {
+	sec, ok, err := m.GetUint64Property(indexedAtProperty)
+	if err != nil || !ok {
+		return time.Time{}, false, err
+	}
+	return time.Unix(int64(sec), 0), true, nil
+}
+
+func (m *Message) setIndexedAt() error {
+	return m.SetUint64Property(indexedAtProperty, uint64(time.Now().Unix()))
+}
+
+// The message property recording the modification time and size of the
+// message file as of the last ReindexIfChanged.
+const fileStatProperty = "nmsync.file-stat"
+
+// Reindex the message if its primary file changed since the last call, as
+// judged by the file's modification time and size, with the given options or
+// the database's defaults if opts is nil. Reports whether the message was
+// reindexed.
+//
+// The file's state is stored in a message property, so the first call on a
+// message always reindexes it.
+func (m *Message) ReindexIfChanged(opts *IndexOpts) (bool, error) {
+	if err := m.check(); err != nil {
+		return false, err
+	}
+	fi, err := os.Stat(m.FileName())
+	if err != nil {
+		return false, err
+	}
+	stat := fmt.Sprintf("%d:%d", fi.ModTime().UnixNano(), fi.Size())
+	if old, _, err := m.GetProperty(fileStatProperty); err != nil || old == stat {
+		return false, err
+	}
+	cOpts, err := m.db.indexOpts(opts)
+	if err != nil {
+		return false, err
+	}
+	st := status(C.notmuch_message_reindex(m.msg, cOpts))
+	if cOpts != nil {
+		C.notmuch_indexopts_destroy(cOpts)
+	}
+	if err = m.db.statusError(st); err != nil {
+		return false, err
+	}
+	if err = m.setIndexedAt(); err != nil {
+		return true, err
+	}
+	if err = m.RemoveAllProperties(fileStatProperty); err != nil {
+		return true, err
+	}
+	return true, m.AddProperty(fileStatProperty, stat)
+}
+
+// Replace the tags of the message with the given ones at once.
+func (m *Message) setTags(tags []string) error {
+	if err := m.Freeze(); err != nil {
+		return err
+	}
+	if err := m.RemoveAllTags(); err != nil {
+		m.Thaw()
+		return err
+	}
+	for _, tag := range tags {
+		if err := m.AddTag(tag); err != nil {
+			m.Thaw()
+			return err
+		}
+	}
+	return m.Thaw()
+}
+
+// Add all of the given tags to the message at once.
+func (m *Message) addTags(tags []string) error {
+	if err := m.Freeze(); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if err := m.AddTag(tag); err != nil {
+			m.Thaw()
+			return err
+		}
+	}
+	return m.Thaw()
+}
+
+// Maildir flags and the tags they correspond to. The "unread" tag is set when
+// the S (seen) flag is absent. Tags marked addOnly are added for their flag but
+// not removed without it.
+var maildirFlagTags = []struct {
+	flag    byte
+	tag     string
+	inverse bool
+	addOnly bool
+}{
+	{'D', "draft", false, false},
+	{'F', "flagged", false, false},
+	{'P', "passed", false, false},
+	{'R', "replied", false, false},
+	{'S', "unread", true, false},
+	{'T', "deleted", false, true},
+}
+
+// Set the message tags from the maildir flags in the ":2,FLAGS" suffix of its
+// primary filename, without depending on the maildir synchronization
+// implemented by the linked libnotmuch.
+//
+// The flags map to tags as follows: D is "draft", F is "flagged", P is
+// "passed", R is "replied", and S (seen) removes "unread". Like libnotmuch's
+// own maildir synchronization, and despite the name, this removes each of
+// these tags if its flag is absent (present for S) as well as adding it.
+//
+// T (trashed) adds "deleted". libnotmuch does not map T at all, so a missing T
+// leaves "deleted" alone: a message tagged "deleted" in notmuch keeps the tag
+// even though its filename has no T. Other tags are left alone, as are all
+// tags if the filename has no ":2," suffix.
+func (m *Message) AddTagsFromFilename() error {
+	if err := m.check(); err != nil {
+		return err
+	}
+	name := filepath.Base(m.FileName())
+	i := strings.LastIndex(name, ":2,")
+	if i < 0 {
+		return nil
+	}
+	flags := name[i+len(":2,"):]
+	if err := m.Freeze(); err != nil {
+		return err
+	}
+	for _, ft := range maildirFlagTags {
+		var err error
+		if (strings.IndexByte(flags, ft.flag) >= 0) != ft.inverse {
+			err = m.AddTag(ft.tag)
+		} else if !ft.addOnly {
+			err = m.RemoveTag(ft.tag)
+		}
+		if err != nil {
+			m.Thaw()
+			return err
+		}
+	}
+	return m.Thaw()
+}
+
+// Move the message's primary file into the maildir 'folder', relative to the
+// database root, and update the index accordingly. Returns the new path.
+//
+// The file keeps its name, and with it its maildir flags, and goes into the
+// same subdirectory (cur/ or new/) of the target folder it was in before. The
+// new path is indexed before the old one is removed, so the message and its
+// tags are kept throughout.
+//
+// Folders outside the database root or inside its .notmuch directory are
+// refused. Moving a message into the folder it is already in does nothing,
+// and an existing file at the new path is never overwritten. If indexing the new
+// path fails, the file is moved back. If it was indexed but IndexFile still
+// returned an error, the move is completed and the new path is returned
+// together with that error.
+func (m *Message) MoveToFolder(db *Database, folder string) (newPath string, err error) {
+	if err := m.check(); err != nil {
+		return "", err
+	}
+	oldPath := m.FileName()
+	if newPath, err = maildirTarget(db, folder, oldPath); err != nil {
+		return "", err
+	}
+	if newPath == oldPath {
+		return newPath, nil
+	}
+	// Unlike os.Rename, os.Link fails if the target exists.
+	if err = os.Link(oldPath, newPath); err != nil {
+		return "", err
+	}
+	if err = os.Remove(oldPath); err != nil {
+		os.Remove(newPath)
+		return "", err
+	}
+	moved, err := db.IndexFile(newPath)
+	if moved == nil {
+		os.Rename(newPath, oldPath)
+		return "", err
+	}
+	moved.Close()
+	// The new path is indexed even if IndexFile failed afterwards, e.g. in
+	// the index hook, so the move is kept like CopyToFolder keeps the copy.
+	if _, rmErr := db.RemoveMessage(oldPath); rmErr != nil {
+		return newPath, rmErr
+	}
+	return newPath, err
+}
+
+// Delete the message's primary file from disk and from the index. Returns
+// whether this was the last file of the message, which is then gone from the
+// database altogether and must not be used any more.
+//
+// The file is first moved aside within its directory and only unlinked once
+// the index has been updated; if that fails, it is moved back.
+func (m *Message) DeleteFromDisk(db *Database) (fullyRemoved bool, err error) {
+	if err := m.check(); err != nil {
+		return false, err
+	}
+	path := m.FileName()
+	aside := filepath.Join(filepath.Dir(path), ".deleting-"+filepath.Base(path))
+	if err := os.Rename(path, aside); err != nil {
+		return false, err
+	}
+	hasMore, err := db.RemoveMessage(path)
+	if err != nil {
+		os.Rename(aside, path)
+		return false, err
+	}
+	return !hasMore, os.Remove(aside)
+}
+
+// Copy the message's primary file into the maildir 'folder', relative to the
+// database root, and index the copy, which adds it as another file of the
+// same message. Returns the message as found through the copy.
+//
+// The copy is placed like MoveToFolder places the file, and an existing file
+// of the same name is never overwritten.
+func (m *Message) CopyToFolder(db *Database, folder string) (*Message, error) {
+	if err := m.check(); err != nil {
+		return nil, err
+	}
+	src, err := m.RawReader()
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	path, err := maildirTarget(db, folder, m.FileName())
+	if err != nil {
+		return nil, err
+	}
+	if err := extractFile(src, path, time.Now()); err != nil {
+		return nil, err
+	}
+	msg, err := db.IndexFile(path)
+	if msg == nil {
+		os.Remove(path)
+	}
+	return msg, err
+}
+
+// Get the path for placing the message file 'path' into the maildir 'folder',
+// creating the folder's maildir directories as needed. Folders are checked
+// like for Deliver.
+func maildirTarget(db *Database, folder, path string) (string, error) {
+	dir, err := db.folderDir(folder)
+	if err != nil {
+		return "", err
+	}
+	if err := makeMaildir(dir); err != nil {
+		return "", err
+	}
+	sub := "cur"
+	if filepath.Base(filepath.Dir(path)) == "new" {
+		sub = "new"
+	}
+	return filepath.Join(dir, sub, filepath.Base(path)), nil
+}
+
+// Mark the message as read by removing the "unread" tag.
+func (m *Message) MarkRead() error {
+	return m.RemoveTag("unread")
+}
+
+// Mark the message as unread by adding the "unread" tag.
+func (m *Message) MarkUnread() error {
+	return m.AddTag("unread")
+}
+
+// Flag the message by adding the "flagged" tag.
+func (m *Message) Flag() error {
+	return m.AddTag("flagged")
+}
+
+// Unflag the message by removing the "flagged" tag.
+func (m *Message) Unflag() error {
+	return m.RemoveTag("flagged")
+}
+
+// Get the value of the message property 'key'. If the property has several
+// values, an arbitrary one of them is returned. The boolean result reports
+// whether the property is set at all.
+func (m *Message) GetProperty(key string) (string, bool, error) {
+	if err := m.check(); err != nil {
+		return "", false, err
+	}
+	var cValue *C.char
+	cKey := C.CString(key)
+	st := status(C.notmuch_message_get_property(m.msg, cKey, &cValue))
+	C.free(unsafe.Pointer(cKey))
+	if st != statusSuccess {
+		return "", false, m.db.statusError(st)
+	}
+	if cValue == nil {
+		return "", false, nil
+	}
+	return C.GoString(cValue), true, nil
+}
+
+// Get all values of the message property 'key', sorted as libnotmuch stores
+// them, which is by value rather than in the order they were added. The
+// result is empty if the property is not set.
+func (m *Message) GetPropertyAll(key string) ([]string, error) {
+	if err := m.check(); err != nil {
+		return nil, err
+	}
+	cKey := C.CString(key)
+	props := C.notmuch_message_get_properties(m.msg, cKey, 1)
+	C.free(unsafe.Pointer(cKey))
+	if props == nil {
+		return nil, statusToError(statusOutOfMemory)
+	}
+	defer C.notmuch_message_properties_destroy(props)
+	var values []string
+	for ; C.notmuch_message_properties_valid(props) != 0; C.notmuch_message_properties_move_to_next(props) {
+		values = append(values, C.GoString(C.notmuch_message_properties_value(props)))
+	}
+	return values, nil
+}
+
+// Add a value to the message property 'key'. Properties may have several
+// values; adding an already present value does nothing.
+func (m *Message) AddProperty(key, value string) error {
+	if err := m.check(); err != nil {
+		return err
+	}
+	cKey := C.CString(key)
+	defer C.free(unsafe.Pointer(cKey))
+	cValue := C.CString(value)
+	defer C.free(unsafe.Pointer(cValue))
+	return m.db.statusError(status(C.notmuch_message_add_property(m.msg, cKey, cValue)))
+}
+
+// Remove a single value from the message property 'key'.
+func (m *Message) RemoveProperty(key, value string) error {
+	if err := m.check(); err != nil {
+		return err
+	}
+	cKey := C.CString(key)
+	defer C.free(unsafe.Pointer(cKey))
+	cValue := C.CString(value)
+	defer C.free(unsafe.Pointer(cValue))
+	return m.db.statusError(status(C.notmuch_message_remove_property(m.msg, cKey, cValue)))
+}
+
+// Remove all values of the message property 'key'. If 'key' is empty, every
+// property of the message is removed.
+func (m *Message) RemoveAllProperties(key string) error {
+	if err := m.check(); err != nil {
+		return err
+	}
+	var cKey *C.char
+	if key != "" {
+		cKey = C.CString(key)
+		defer C.free(unsafe.Pointer(cKey))
+	}
+	return m.db.statusError(status(C.notmuch_message_remove_all_properties(m.msg, cKey)))
+}
+
+// Set the message property 'key' to the single value v, stored as a decimal
+// string, replacing any previous values.
+func (m *Message) SetUint64Property(key string, v uint64) error {
+	if err := m.RemoveAllProperties(key); err != nil {
+		return err
+	}
+	return m.AddProperty(key, strconv.FormatUint(v, 10))
+}
+
+// Get the value of the message property 'key' as set by SetUint64Property.
+// The boolean result reports whether the property is set at all.
+func (m *Message) GetUint64Property(key string) (uint64, bool, error) {
+	value, ok, err := m.GetProperty(key)
+	if err != nil || !ok {
+		return 0, false, err
+	}
+	v, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, false, err
+	}
+	return v, true, nil
+}
+
+// The message property under which notmuch stashes the session keys of
+// encrypted parts when indexing with decryption enabled.
+const sessionKeyProperty = "session-key"
+
+// Check whether any session keys for encrypted parts are stashed with the
+// message.
+func (m *Message) HasSessionKeys() (bool, error) {
+	_, ok, err := m.GetProperty(sessionKeyProperty)
+	return ok, err
+}
+
+// Remove all session keys stashed with the message.
+//
+// Note that without the session keys a message that was indexed with
+// decryption can no longer be decrypted without the user's secret key.
+func (m *Message) ClearSessionKeys() error {
+	return m.RemoveAllProperties(sessionKeyProperty)
 }
 
 // Freeze the current state of the message within the database.
@@ -205,11 +3642,17 @@ func (m *Message) RemoveAllTags() error {
 // Message.RemoveTag(), and Message.RemoveAllTags()), will not be committed to
 // the database until the message is thawed with Thaw().
 func (m *Message) Freeze() error {
-	return statusToError(status(C.notmuch_message_freeze(m.msg)))
+	if err := m.check(); err != nil {
+		return err
+	}
+	return m.db.statusError(status(C.notmuch_message_freeze(m.msg)))
 }
 
 // Thaw the message, synchronizing any changes that may have occurred while
 // message was frozen into the notmuch database.
 func (m *Message) Thaw() error {
-	return statusToError(status(C.notmuch_message_thaw(m.msg)))
+	if err := m.check(); err != nil {
+		return err
+	}
+	return m.db.statusError(status(C.notmuch_message_thaw(m.msg)))
 }
@@ -1,9 +1,21 @@
 package notmuch
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 const message = `From: Sample Message <return@example.com>
@@ -122,3 +134,2679 @@ func TestNotmuch(t *testing.T) {
 		t.Errorf("Invalid message tags: %v", tags)
 	}
 }
+
+// Create a new notmuch database in a temporary directory. The returned function
+// closes the database and removes the directory.
+func newTestDB(t *testing.T) (*Database, string, func()) {
+	db, cleanup, err := NewTemp()
+	if err != nil {
+		t.Fatalf("Could not create new notmuch DB: %s", err)
+	}
+	return db, db.RootPath(), cleanup
+}
+
+// Write content to file 'name' under the database root and index it.
+func indexTestMessage(t *testing.T, db *Database, root, name, content string) *Message {
+	path := filepath.Join(root, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Could not create message dir: %s", err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Could not write message: %s", err)
+	}
+	msg, err := db.IndexFile(path)
+	if err != nil {
+		t.Fatalf("Error in IndexFile: %s", err)
+	}
+	return msg
+}
+
+func TestLastModified(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	msg := indexTestMessage(t, db, root, "msg", message)
+	before, err := msg.LastModified()
+	if err != nil {
+		t.Fatalf("Error in LastModified: %s", err)
+	}
+	if err = msg.AddTag("tag1"); err != nil {
+		t.Fatalf("Error in AddTag: %s", err)
+	}
+	after, err := msg.LastModified()
+	if err != nil {
+		t.Fatalf("Error in LastModified: %s", err)
+	}
+	t.Logf("Message revision %d -> %d", before, after)
+	if after <= before {
+		t.Errorf("Revision did not increase after tag change: %d -> %d", before, after)
+	}
+}
+
+func TestWithReadWrite(t *testing.T) {
+	root, err := ioutil.TempDir("", "nm-")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(root)
+	db, err := New(root)
+	if err != nil {
+		t.Fatalf("Could not create new notmuch DB: %s", err)
+	}
+	db.Close()
+
+	var id string
+	err = WithReadWrite(root, func(db *Database) error {
+		id = indexTestMessage(t, db, root, "msg", message).ID()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error in WithReadWrite: %s", err)
+	}
+
+	err = WithReadOnly(root, func(db *Database) error {
+		msg, err := db.FindMessage(id)
+		if err != nil {
+			return err
+		}
+		if msg == nil {
+			t.Errorf("Message %s not found after session", id)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error in WithReadOnly: %s", err)
+	}
+}
+
+func containsTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func TestReadAndFlagged(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	msg := indexTestMessage(t, db, root, "msg", message)
+	tests := []struct {
+		name string
+		op   func() error
+		tag  string
+		want bool
+	}{
+		{"MarkUnread", msg.MarkUnread, "unread", true},
+		{"MarkRead", msg.MarkRead, "unread", false},
+		{"Flag", msg.Flag, "flagged", true},
+		{"Unflag", msg.Unflag, "flagged", false},
+	}
+	for _, tt := range tests {
+		if err := tt.op(); err != nil {
+			t.Errorf("Error in %s: %s", tt.name, err)
+			continue
+		}
+		tags := msg.Tags()
+		if containsTag(tags, tt.tag) != tt.want {
+			t.Errorf("After %s: invalid message tags: %v", tt.name, tags)
+		}
+	}
+}
+
+func TestIndexBytes(t *testing.T) {
+	db, _, cleanup := newTestDB(t)
+	defer cleanup()
+
+	msg, err := db.IndexBytes([]byte(message), nil)
+	if err != nil {
+		t.Fatalf("Error in IndexBytes: %s", err)
+	}
+	if id := msg.ID(); id != "00000000-0000-0000-0000-000000000000@example.com" {
+		t.Errorf("Invalid message ID: %s", id)
+	}
+	data, err := ioutil.ReadFile(msg.FileName())
+	if err != nil {
+		t.Fatalf("Could not read indexed file: %s", err)
+	}
+	if string(data) != message {
+		t.Errorf("Indexed file content differs from the message")
+	}
+
+	other, err := db.IndexBytes([]byte(testMessage("opts")), &IndexOpts{DecryptPolicy: DecryptNoStash})
+	if err != nil {
+		t.Fatalf("Error in IndexBytes with options: %s", err)
+	}
+	if id := other.ID(); id != "opts@example.com" {
+		t.Errorf("Invalid message ID: %s", id)
+	}
+	if _, err := db.IndexBytes([]byte(testMessage("bad")), &IndexOpts{DecryptPolicy: 42}); err == nil {
+		t.Errorf("IndexBytes accepted an invalid decryption policy")
+	}
+}
+
+func TestIndexFileWithContent(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err := zw.Write([]byte(message)); err != nil {
+		t.Fatalf("Error compressing message: %s", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Error compressing message: %s", err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(compressed.Bytes()))
+	if err != nil {
+		t.Fatalf("Error decompressing message: %s", err)
+	}
+	msg, err := db.IndexFileWithContent("INBOX/cur/msg:2,", zr, nil)
+	if err != nil {
+		t.Fatalf("Error in IndexFileWithContent: %s", err)
+	}
+	path := filepath.Join(root, "INBOX", "cur", "msg:2,")
+	if msg.FileName() != path {
+		t.Errorf("Message indexed as %s, want %s", msg.FileName(), path)
+	}
+	if id := msg.ID(); id != "00000000-0000-0000-0000-000000000000@example.com" {
+		t.Errorf("Invalid message ID: %s", id)
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != message {
+		t.Errorf("Indexed file does not hold the content: %v", err)
+	}
+
+	// An existing file is not replaced.
+	if _, err := db.IndexFileWithContent(path, strings.NewReader(testMessage("other")), nil); err == nil {
+		t.Errorf("IndexFileWithContent replaced an existing file")
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != message {
+		t.Errorf("Existing file changed: %v", err)
+	}
+	if names, err := filepath.Glob(filepath.Join(root, "INBOX", "cur", ".index-*")); err != nil || len(names) != 0 {
+		t.Errorf("Temporary files left behind: %v, %v", names, err)
+	}
+}
+
+func TestOpenOrCreate(t *testing.T) {
+	root, err := ioutil.TempDir("", "nm-")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	if _, err = OpenOrCreate(root, true); err == nil {
+		t.Fatal("OpenOrCreate created a database in read-only mode")
+	}
+
+	db, err := OpenOrCreate(root, false)
+	if err != nil {
+		t.Fatalf("Could not create notmuch DB: %s", err)
+	}
+	id := indexTestMessage(t, db, root, "msg", message).ID()
+	db.Close()
+
+	db, err = OpenOrCreate(root, true)
+	if err != nil {
+		t.Fatalf("Could not open existing notmuch DB: %s", err)
+	}
+	defer db.Close()
+	msg, err := db.FindMessage(id)
+	if err != nil {
+		t.Fatalf("Error in db.FindMessage: %s", err)
+	}
+	if msg == nil {
+		t.Errorf("Message %s not found in existing DB", id)
+	}
+}
+
+func TestSubject(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	msg := indexTestMessage(t, db, root, "msg", message)
+	if s := msg.Subject(false); s != "Some test message" {
+		t.Errorf("Invalid subject: %q", s)
+	}
+
+	reply := strings.NewReplacer(
+		"Subject: ", "Subject: Re: ",
+		"Message-Id: <00000000", "Message-Id: <11111111",
+	).Replace(message)
+	msg = indexTestMessage(t, db, root, "reply", reply)
+	if s := msg.Subject(false); s != "Re: Some test message" {
+		t.Errorf("Invalid undecorated subject: %q", s)
+	}
+	if s := msg.Subject(true); s != "Some test message" {
+		t.Errorf("Invalid stripped subject: %q", s)
+	}
+}
+
+func TestAddresses(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	msg := indexTestMessage(t, db, root, "msg", message)
+	from, err := msg.From()
+	if err != nil {
+		t.Fatalf("Error in From: %s", err)
+	}
+	if from.Name != "Sample Message" || from.Address != "return@example.com" {
+		t.Errorf("Invalid From address: %v", from)
+	}
+
+	multi := strings.NewReplacer(
+		"To: Test Account <test@example.com>", "To: Test Account <test@example.com>, other@example.com",
+		"Message-Id: <00000000", "Message-Id: <11111111",
+	).Replace(message)
+	msg = indexTestMessage(t, db, root, "multi", multi)
+	to, err := msg.To()
+	if err != nil {
+		t.Fatalf("Error in To: %s", err)
+	}
+	if len(to) != 2 || to[0].Address != "test@example.com" || to[1].Address != "other@example.com" {
+		t.Errorf("Invalid To addresses: %v", to)
+	}
+
+	malformed := strings.NewReplacer(
+		"From: Sample Message <return@example.com>", "From: Sample Message <return",
+		"Message-Id: <00000000", "Message-Id: <22222222",
+	).Replace(message)
+	msg = indexTestMessage(t, db, root, "malformed", malformed)
+	if _, err = msg.From(); err == nil {
+		t.Error("From should fail on a malformed address")
+	}
+}
+
+func TestDatabaseClose(t *testing.T) {
+	db, _, cleanup := newTestDB(t)
+	defer cleanup()
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Error in Close: %s", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Errorf("Error in second Close: %s", err)
+	}
+	if _, err := db.FindMessage("doesnt-exist"); err != ErrDatabaseClosed {
+		t.Errorf("FindMessage after Close returned %v, want ErrDatabaseClosed", err)
+	}
+}
+
+func TestMessageClose(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	msg := indexTestMessage(t, db, root, "msg", message)
+	msg.Close()
+	msg.Close()
+
+	if id := msg.ID(); id != "" {
+		t.Errorf("ID after Close returned %q", id)
+	}
+	if tags := msg.Tags(); tags != nil {
+		t.Errorf("Tags after Close returned %v", tags)
+	}
+	if err := msg.AddTag("tag1"); err != ErrMessageClosed {
+		t.Errorf("AddTag after Close returned %v, want ErrMessageClosed", err)
+	}
+	if err := msg.Freeze(); err != ErrMessageClosed {
+		t.Errorf("Freeze after Close returned %v, want ErrMessageClosed", err)
+	}
+}
+
+func TestMessageAfterDatabaseClose(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	msg := indexTestMessage(t, db, root, "msg", message)
+	db.Close()
+
+	if id := msg.ID(); id != "" {
+		t.Errorf("ID after closing the database returned %q", id)
+	}
+	if tags := msg.Tags(); tags != nil {
+		t.Errorf("Tags after closing the database returned %v", tags)
+	}
+	if h := msg.Header("Subject"); h != "" {
+		t.Errorf("Header after closing the database returned %q", h)
+	}
+	if err := msg.AddTag("tag1"); err != ErrDatabaseClosed {
+		t.Errorf("AddTag after closing the database returned %v, want ErrDatabaseClosed", err)
+	}
+	if _, _, err := msg.GetProperty("key"); err != ErrDatabaseClosed {
+		t.Errorf("GetProperty after closing the database returned %v, want ErrDatabaseClosed", err)
+	}
+	msg.Close()
+}
+
+func TestRefresh(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+	db.Close()
+
+	reader, err := Open(root, true)
+	if err != nil {
+		t.Fatalf("Could not open notmuch DB: %s", err)
+	}
+	defer reader.Close()
+
+	writer, err := Open(root, false)
+	if err != nil {
+		t.Fatalf("Could not open notmuch DB: %s", err)
+	}
+	id := indexTestMessage(t, writer, root, "msg", message).ID()
+	if err = writer.Close(); err != nil {
+		t.Fatalf("Error in Close: %s", err)
+	}
+
+	if err = reader.Refresh(); err != nil {
+		t.Fatalf("Error in Refresh: %s", err)
+	}
+	msg, err := reader.FindMessage(id)
+	if err != nil {
+		t.Fatalf("Error in db.FindMessage: %s", err)
+	}
+	if msg == nil {
+		t.Errorf("Message %s not found after Refresh", id)
+	}
+}
+
+func TestIndexFileError(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	path := filepath.Join(root, "not-an-email")
+	if err := ioutil.WriteFile(path, []byte("This is not an email.\n"), 0644); err != nil {
+		t.Fatalf("Could not write file: %s", err)
+	}
+	_, err := db.IndexFile(path)
+	if err == nil {
+		t.Fatal("IndexFile succeeded on a non-email file")
+	}
+	t.Logf("IndexFile error: %s", err)
+	if !strings.Contains(err.Error(), path) {
+		t.Errorf("Error %q does not mention %s", err, path)
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	path := filepath.Join(root, "doesnt-exist")
+	_, err := db.IndexFile(path)
+	var e Error
+	if !errors.As(err, &e) {
+		t.Fatalf("IndexFile error %v is not an Error", err)
+	}
+	if e.Code == int(statusSuccess) || e.Op != "index" || e.Path != path {
+		t.Errorf("Invalid error: %#v", e)
+	}
+}
+
+func TestFindMessageByFilename(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	id := indexTestMessage(t, db, root, "msg", message).ID()
+	msg, err := db.FindMessageByFilename(filepath.Join(root, "msg"))
+	if err != nil {
+		t.Fatalf("Error in FindMessageByFilename: %s", err)
+	}
+	if msg == nil || msg.ID() != id {
+		t.Errorf("Message %s not found by filename", id)
+	}
+}
+
+func TestIndexFileResult(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	for i, name := range []string{"msg1", "msg2"} {
+		path := filepath.Join(root, name)
+		if err := ioutil.WriteFile(path, []byte(message), 0644); err != nil {
+			t.Fatalf("Could not write message: %s", err)
+		}
+		res, err := db.IndexFileResult(path)
+		if err != nil {
+			t.Fatalf("Error in IndexFileResult: %s", err)
+		}
+		if want := i > 0; res.Merged != want {
+			t.Errorf("Indexing %s: Merged = %v, want %v", name, res.Merged, want)
+		}
+	}
+}
+
+func TestForEachTag(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	msg := indexTestMessage(t, db, root, "msg", message)
+	for _, tag := range []string{"tag1", "tag2", "tag3"} {
+		if err := msg.AddTag(tag); err != nil {
+			t.Fatalf("Error in AddTag: %s", err)
+		}
+	}
+
+	all, err := db.AllTags()
+	if err != nil {
+		t.Fatalf("Error in AllTags: %s", err)
+	}
+	var tags []string
+	err = db.ForEachTag(func(tag string) error {
+		tags = append(tags, tag)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error in ForEachTag: %s", err)
+	}
+	if len(tags) != 3 || len(all) != 3 {
+		t.Fatalf("Invalid database tags: %v, %v", tags, all)
+	}
+	for i := range tags {
+		if tags[i] != all[i] {
+			t.Errorf("ForEachTag %v differs from AllTags %v", tags, all)
+		}
+	}
+
+	stop := errors.New("stop")
+	n := 0
+	err = db.ForEachTag(func(tag string) error {
+		n++
+		return stop
+	})
+	if err != stop || n != 1 {
+		t.Errorf("ForEachTag did not stop on error: err = %v, %d calls", err, n)
+	}
+}
+
+func TestConfigValues(t *testing.T) {
+	db, _, cleanup := newTestDB(t)
+	defer cleanup()
+
+	if err := db.SetConfigValues("new.tags", []string{"a", "b"}); err != nil {
+		t.Fatalf("Error in SetConfigValues: %s", err)
+	}
+	values, err := db.GetConfigValues("new.tags")
+	if err != nil {
+		t.Fatalf("Error in GetConfigValues: %s", err)
+	}
+	if len(values) != 2 || values[0] != "a" || values[1] != "b" {
+		t.Errorf("Invalid config values: %v", values)
+	}
+}
+
+func TestHasTag(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	msg := indexTestMessage(t, db, root, "msg", message)
+	if err := msg.AddTag("tag1"); err != nil {
+		t.Fatalf("Error in AddTag: %s", err)
+	}
+	if !msg.HasTag("tag1") {
+		t.Error("HasTag(tag1) should be true")
+	}
+	if msg.HasTag("tag2") {
+		t.Error("HasTag(tag2) should be false")
+	}
+}
+
+func benchmarkTagged(b *testing.B) (*Message, func()) {
+	root, err := ioutil.TempDir("", "nm-")
+	if err != nil {
+		b.Fatalf("Could not create temp dir: %s", err)
+	}
+	db, err := New(root)
+	if err != nil {
+		os.RemoveAll(root)
+		b.Fatalf("Could not create new notmuch DB: %s", err)
+	}
+	cleanup := func() {
+		db.Close()
+		os.RemoveAll(root)
+	}
+	msg, err := db.IndexBytes([]byte(message), nil)
+	if err != nil {
+		cleanup()
+		b.Fatalf("Error in IndexBytes: %s", err)
+	}
+	for _, tag := range []string{"inbox", "unread", "list", "work", "tag1"} {
+		if err = msg.AddTag(tag); err != nil {
+			cleanup()
+			b.Fatalf("Error in AddTag: %s", err)
+		}
+	}
+	return msg, cleanup
+}
+
+func BenchmarkHasTag(b *testing.B) {
+	msg, cleanup := benchmarkTagged(b)
+	defer cleanup()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		msg.HasTag("unread")
+	}
+}
+
+func BenchmarkTagsContains(b *testing.B) {
+	msg, cleanup := benchmarkTagged(b)
+	defer cleanup()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		containsTag(msg.Tags(), "unread")
+	}
+}
+
+func TestMessageDirectory(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	msg := indexTestMessage(t, db, root, "INBOX/cur/msg", message)
+	dir, err := msg.Directory(db)
+	if err != nil {
+		t.Fatalf("Error in Directory: %s", err)
+	}
+	if dir == nil {
+		t.Fatal("Message directory not found")
+	}
+	if mtime := dir.MTime(); !mtime.IsZero() {
+		t.Errorf("Unexpected initial mtime: %s", mtime)
+	}
+	mtime := time.Unix(1519596000, 0)
+	if err = dir.SetMTime(mtime); err != nil {
+		t.Fatalf("Error in SetMTime: %s", err)
+	}
+
+	dir, err = db.Directory("INBOX/cur")
+	if err != nil {
+		t.Fatalf("Error in db.Directory: %s", err)
+	}
+	if got := dir.MTime(); !got.Equal(mtime) {
+		t.Errorf("Invalid directory mtime: %s, want %s", got, mtime)
+	}
+}
+
+func TestEncodedHeaders(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	encoded := strings.NewReplacer(
+		"Subject: Some test message", "Subject: =?UTF-8?Q?Caf=C3=A9_menu?=",
+		"From: Sample Message", "From: =?UTF-8?Q?Se=C3=B1or_Sample?=",
+	).Replace(message)
+	msg := indexTestMessage(t, db, root, "msg", encoded)
+	if s := msg.Subject(false); s != "Café menu" {
+		t.Errorf("Invalid decoded subject: %q", s)
+	}
+	from, err := msg.From()
+	if err != nil {
+		t.Fatalf("Error in From: %s", err)
+	}
+	if from.Name != "Señor Sample" {
+		t.Errorf("Invalid decoded From name: %q", from.Name)
+	}
+
+	if s := decodeHeader("Caf\xe9"); s != "Caf\uFFFD" {
+		t.Errorf("Invalid UTF-8 not sanitized: %q", s)
+	}
+}
+
+func TestOpenWith(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+	indexTestMessage(t, db, root, "msg", message)
+	db.Close()
+
+	db, err := OpenWith(root, OpenOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Error in OpenWith: %s", err)
+	}
+	defer db.Close()
+	if _, err = db.IndexBytes([]byte(message), nil); err == nil {
+		t.Error("IndexBytes succeeded on a read-only database")
+	}
+}
+
+func TestRawReader(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	indexTestMessage(t, db, root, "msg1", message)
+	msg := indexTestMessage(t, db, root, "msg2", message)
+	if n := len(msg.FileNames()); n != 2 {
+		t.Fatalf("Message has %d filenames, want 2", n)
+	}
+
+	for i := 0; i < 2; i++ {
+		r, err := msg.RawReader()
+		if err != nil {
+			t.Fatalf("Error in RawReader: %s", err)
+		}
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("Could not read message: %s", err)
+		}
+		if string(data) != message {
+			t.Errorf("Raw message differs from the indexed file")
+		}
+		// Read through the remaining filename the second time.
+		os.Remove(msg.FileName())
+	}
+}
+
+func TestMessageExists(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	id := indexTestMessage(t, db, root, "msg", message).ID()
+	for _, tt := range []struct {
+		id   string
+		want bool
+	}{{id, true}, {"doesnt-exist", false}} {
+		exists, err := db.MessageExists(tt.id)
+		if err != nil {
+			t.Fatalf("Error in MessageExists: %s", err)
+		}
+		if exists != tt.want {
+			t.Errorf("MessageExists(%q) = %v, want %v", tt.id, exists, tt.want)
+		}
+	}
+}
+
+func BenchmarkMessageExists(b *testing.B) {
+	msg, cleanup := benchmarkTagged(b)
+	defer cleanup()
+	id := msg.ID()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		msg.db.MessageExists(id)
+	}
+}
+
+func BenchmarkFindMessageExists(b *testing.B) {
+	msg, cleanup := benchmarkTagged(b)
+	defer cleanup()
+	id := msg.ID()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		found, _ := msg.db.FindMessage(id)
+		_ = found != nil
+	}
+}
+
+func TestSessionKeys(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	msg := indexTestMessage(t, db, root, "msg", message)
+	if has, err := msg.HasSessionKeys(); err != nil || has {
+		t.Fatalf("HasSessionKeys on a fresh message = %v, %v", has, err)
+	}
+	if err := msg.AddProperty("session-key", "9:0123456789ABCDEF"); err != nil {
+		t.Fatalf("Error in AddProperty: %s", err)
+	}
+	if has, err := msg.HasSessionKeys(); err != nil || !has {
+		t.Errorf("HasSessionKeys after stashing a key = %v, %v", has, err)
+	}
+	if err := msg.ClearSessionKeys(); err != nil {
+		t.Fatalf("Error in ClearSessionKeys: %s", err)
+	}
+	if has, err := msg.HasSessionKeys(); err != nil || has {
+		t.Errorf("HasSessionKeys after clearing = %v, %v", has, err)
+	}
+}
+
+func TestQueryError(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	indexTestMessage(t, db, root, "msg", message)
+	_, err := db.countMessages("from:(")
+	if err == nil {
+		t.Skip("Linked libnotmuch accepts unbalanced parentheses")
+	}
+	t.Logf("Query error: %s", err)
+	if !strings.Contains(err.Error(), `"from:("`) {
+		t.Errorf("Error %q does not mention the query", err)
+	}
+}
+
+// Run with -race to check that finalizers don't call into libnotmuch
+// concurrently with the database.
+func TestFinalizers(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	id := indexTestMessage(t, db, root, "msg", message).ID()
+	for i := 0; i < 1000; i++ {
+		msg, err := db.FindMessage(id)
+		if err != nil {
+			t.Fatalf("Error in db.FindMessage: %s", err)
+		}
+		if err = msg.AddTag("tag1"); err != nil {
+			t.Fatalf("Error in AddTag: %s", err)
+		}
+		if i%100 == 0 {
+			runtime.GC()
+		}
+	}
+
+	if _, err := db.FindMessage(id); err != nil {
+		t.Fatalf("Error in db.FindMessage: %s", err)
+	}
+	db.Close()
+	// Finalizers of messages freed by Close must not touch them again.
+	runtime.GC()
+	runtime.GC()
+}
+
+// Return the sample message with Message-Id <id@example.com> and the given
+// old, new string replacements applied.
+func testMessage(id string, oldnew ...string) string {
+	oldnew = append(oldnew, "<00000000-0000-0000-0000-000000000000@example.com>", "<"+id+"@example.com>")
+	return strings.NewReplacer(oldnew...).Replace(message)
+}
+
+func TestTagHistogram(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	dates := []string{
+		"Mon, 26 Feb 2018 10:00:00 +0000",
+		"Mon, 26 Feb 2018 18:00:00 +0000",
+		"Tue, 27 Feb 2018 09:00:00 +0000",
+	}
+	for i, date := range dates {
+		id := fmt.Sprintf("msg%d", i)
+		content := testMessage(id, "Mon, 26 Feb 2018 00:00:00 +0200", date)
+		if err := indexTestMessage(t, db, root, id, content).AddTag("tag1"); err != nil {
+			t.Fatalf("Error in AddTag: %s", err)
+		}
+	}
+
+	hist, err := db.TagHistogram("tag1", 24*time.Hour)
+	if err != nil {
+		t.Fatalf("Error in TagHistogram: %s", err)
+	}
+	t.Logf("Histogram: %v", hist)
+	day1 := time.Date(2018, 2, 26, 0, 0, 0, 0, time.UTC)
+	day2 := time.Date(2018, 2, 27, 0, 0, 0, 0, time.UTC)
+	if len(hist) != 2 || hist[day1] != 2 || hist[day2] != 1 {
+		t.Errorf("Invalid histogram: %v", hist)
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	indexTestMessage(t, db, root, "inbox/msg", message)
+	id := indexTestMessage(t, db, root, "archive/msg", message).ID()
+	indexTestMessage(t, db, root, "inbox/other", testMessage("other"))
+
+	dups, err := db.Duplicates()
+	if err != nil {
+		t.Fatalf("Error in Duplicates: %s", err)
+	}
+	t.Logf("Duplicates: %v", dups)
+	if len(dups) != 1 || len(dups[id]) != 2 {
+		t.Errorf("Invalid duplicates report: %v", dups)
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	msg, err := db.Deliver([]byte(message), "INBOX", []string{"inbox", "unread"})
+	if err != nil {
+		t.Fatalf("Error in Deliver: %s", err)
+	}
+	path := msg.FileName()
+	if dir := filepath.Dir(path); dir != filepath.Join(root, "INBOX", "new") {
+		t.Errorf("Message delivered to %s", path)
+	}
+	if _, err = os.Stat(path); err != nil {
+		t.Errorf("Delivered file missing: %s", err)
+	}
+
+	found, err := db.FindMessage(msg.ID())
+	if err != nil {
+		t.Fatalf("Error in db.FindMessage: %s", err)
+	}
+	if found == nil {
+		t.Fatalf("Delivered message %s not indexed", msg.ID())
+	}
+	if !found.HasTag("inbox") || !found.HasTag("unread") {
+		t.Errorf("Invalid message tags: %v", found.Tags())
+	}
+
+	for _, folder := range []string{"../outside", ".notmuch", "/abs", "INBOX/../.."} {
+		if _, err := db.Deliver([]byte(testMessage("bad")), folder, nil); err == nil {
+			t.Errorf("Deliver into %q succeeded", folder)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(root), "outside")); !os.IsNotExist(err) {
+		t.Errorf("Deliver created a maildir outside the database: %v", err)
+	}
+}
+
+func TestSize(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	indexTestMessage(t, db, root, "msg1", message)
+	msg := indexTestMessage(t, db, root, "msg2", message)
+	for i := 0; i < 2; i++ {
+		size, err := msg.Size()
+		if err != nil {
+			t.Fatalf("Error in Size: %s", err)
+		}
+		if size != int64(len(message)) {
+			t.Errorf("Size = %d, want %d", size, len(message))
+		}
+		// Stat the remaining filename the second time.
+		os.Remove(msg.FileName())
+	}
+}
+
+func TestReindexIfChanged(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	msg := indexTestMessage(t, db, root, "msg", message)
+	mtime := time.Now().Add(-time.Hour)
+	for i, tt := range []struct {
+		touch bool
+		opts  *IndexOpts
+		want  bool
+	}{
+		{false, nil, true},
+		{false, nil, false},
+		{true, &IndexOpts{DecryptPolicy: DecryptFalse}, true},
+		{false, &IndexOpts{DecryptPolicy: DecryptFalse}, false},
+	} {
+		if tt.touch {
+			mtime = mtime.Add(time.Minute)
+			if err := os.Chtimes(msg.FileName(), mtime, mtime); err != nil {
+				t.Fatalf("Could not touch message file: %s", err)
+			}
+		}
+		reindexed, err := msg.ReindexIfChanged(tt.opts)
+		if err != nil {
+			t.Fatalf("Error in ReindexIfChanged: %s", err)
+		}
+		if reindexed != tt.want {
+			t.Errorf("Call %d: reindexed = %v, want %v", i, reindexed, tt.want)
+		}
+	}
+}
+
+// Run with -race to check that Do serializes access to the database.
+func TestDo(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	id := indexTestMessage(t, db, root, "msg", message).ID()
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(tag string) {
+			defer wg.Done()
+			errs <- db.Do(func() error {
+				msg, err := db.FindMessage(id)
+				if err != nil {
+					return err
+				}
+				if err = msg.Freeze(); err != nil {
+					return err
+				}
+				if err = msg.AddTag(tag); err != nil {
+					return err
+				}
+				return db.Do(msg.Thaw)
+			})
+		}(fmt.Sprintf("tag%d", i))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Error in Do: %s", err)
+		}
+	}
+
+	err := db.Do(func() error {
+		msg, err := db.FindMessage(id)
+		if err != nil {
+			return err
+		}
+		if tags := msg.Tags(); len(tags) != 10 {
+			t.Errorf("Invalid message tags: %v", tags)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Error in Do: %s", err)
+	}
+}
+
+func TestFileCountOnDisk(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	indexTestMessage(t, db, root, "INBOX/cur/msg", message)
+	dir, err := db.Directory("INBOX/cur")
+	if err != nil {
+		t.Fatalf("Error in db.Directory: %s", err)
+	}
+	counts := func() (int, int) {
+		n, err := dir.FileCountOnDisk()
+		if err != nil {
+			t.Fatalf("Error in FileCountOnDisk: %s", err)
+		}
+		return n, len(dir.ChildFiles())
+	}
+	if onDisk, indexed := counts(); onDisk != 1 || indexed != 1 {
+		t.Errorf("Counts before adding a file: %d on disk, %d indexed", onDisk, indexed)
+	}
+
+	path := filepath.Join(root, "INBOX", "cur", "new-msg")
+	if err = ioutil.WriteFile(path, []byte(testMessage("new")), 0644); err != nil {
+		t.Fatalf("Could not write message: %s", err)
+	}
+	if onDisk, indexed := counts(); onDisk != 2 || indexed != 1 {
+		t.Errorf("Counts after adding a file: %d on disk, %d indexed", onDisk, indexed)
+	}
+}
+
+func TestAddTagsFromFilename(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	msg := indexTestMessage(t, db, root, "INBOX/cur/1519596000.M1P1.host:2,SR", message)
+	for _, tag := range []string{"unread", "deleted"} {
+		if err := msg.AddTag(tag); err != nil {
+			t.Fatalf("Error in AddTag: %s", err)
+		}
+	}
+	if err := msg.AddTagsFromFilename(); err != nil {
+		t.Fatalf("Error in AddTagsFromFilename: %s", err)
+	}
+	tags := msg.Tags()
+	if !msg.HasTag("replied") || msg.HasTag("unread") || msg.HasTag("flagged") {
+		t.Errorf("Invalid message tags: %v", tags)
+	}
+	// Without T, a "deleted" tag set in notmuch is kept.
+	if !msg.HasTag("deleted") {
+		t.Errorf("AddTagsFromFilename removed the deleted tag: %v", tags)
+	}
+
+	trashed := indexTestMessage(t, db, root, "INBOX/cur/1519596000.M2P1.host:2,ST", testMessage("trashed"))
+	if err := trashed.AddTagsFromFilename(); err != nil {
+		t.Fatalf("Error in AddTagsFromFilename: %s", err)
+	}
+	if !trashed.HasTag("deleted") {
+		t.Errorf("T flag did not add the deleted tag: %v", trashed.Tags())
+	}
+}
+
+func TestChangesSince(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	msg := indexTestMessage(t, db, root, "msg", message)
+	indexTestMessage(t, db, root, "other", testMessage("other"))
+	rev := db.Revision()
+	if err := msg.AddTag("tag1"); err != nil {
+		t.Fatalf("Error in AddTag: %s", err)
+	}
+
+	changes, err := db.ChangesSince(rev)
+	if err != nil {
+		t.Fatalf("Error in ChangesSince: %s", err)
+	}
+	t.Logf("Changes since %d: %v", rev, changes)
+	if len(changes) != 1 {
+		t.Fatalf("Invalid changes: %v", changes)
+	}
+	c := changes[0]
+	if c.ID != msg.ID() || !containsTag(c.Tags, "tag1") || c.Rev <= rev {
+		t.Errorf("Invalid change: %v", c)
+	}
+}
+
+func TestMoveToFolder(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	name := "1519596000.M1P1.host:2,S"
+	msg := indexTestMessage(t, db, root, "INBOX/cur/"+name, message)
+	oldPath := msg.FileName()
+	if err := msg.AddTag("tag1"); err != nil {
+		t.Fatalf("Error in AddTag: %s", err)
+	}
+
+	newPath, err := msg.MoveToFolder(db, "Archive")
+	if err != nil {
+		t.Fatalf("Error in MoveToFolder: %s", err)
+	}
+	if want := filepath.Join(root, "Archive", "cur", name); newPath != want {
+		t.Errorf("Message moved to %s, want %s", newPath, want)
+	}
+	if _, err = os.Stat(oldPath); !os.IsNotExist(err) {
+		t.Errorf("Old file still exists: %v", err)
+	}
+
+	if old, err := db.FindMessageByFilename(oldPath); err != nil || old != nil {
+		t.Errorf("Old path still indexed: %v, %v", old, err)
+	}
+	moved, err := db.FindMessageByFilename(newPath)
+	if err != nil {
+		t.Fatalf("Error in FindMessageByFilename: %s", err)
+	}
+	if moved == nil {
+		t.Fatal("New path not indexed")
+	}
+	if !moved.HasTag("tag1") {
+		t.Errorf("Tags lost in move: %v", moved.Tags())
+	}
+
+	// Moving into the current folder must not drop the only filename.
+	samePath, err := moved.MoveToFolder(db, "Archive")
+	if err != nil || samePath != newPath {
+		t.Errorf("MoveToFolder into the same folder = %q, %v, want %s", samePath, err, newPath)
+	}
+	if same, err := db.FindMessageByFilename(newPath); err != nil || same == nil || !same.HasTag("tag1") {
+		t.Errorf("Message lost by moving into the same folder: %v, %v", same, err)
+	}
+
+	// An existing file at the target is not overwritten.
+	taken := filepath.Join(root, "Spam", "cur", name)
+	if err := os.MkdirAll(filepath.Dir(taken), 0755); err != nil {
+		t.Fatalf("Could not create dir: %s", err)
+	}
+	if err := ioutil.WriteFile(taken, []byte("other"), 0600); err != nil {
+		t.Fatalf("Could not write file: %s", err)
+	}
+	if _, err := moved.MoveToFolder(db, "Spam"); err == nil {
+		t.Errorf("MoveToFolder overwrote an existing file")
+	}
+	if data, err := ioutil.ReadFile(taken); err != nil || string(data) != "other" {
+		t.Errorf("Existing file changed: %q, %v", data, err)
+	}
+	if _, err := os.Stat(newPath); err != nil {
+		t.Errorf("Message file gone after refused move: %s", err)
+	}
+
+	// Folders outside the database are refused.
+	for _, folder := range []string{"..", ".notmuch", "/abs"} {
+		if _, err := moved.MoveToFolder(db, folder); err == nil {
+			t.Errorf("MoveToFolder into %q succeeded", folder)
+		}
+		if _, err := moved.CopyToFolder(db, folder); err == nil {
+			t.Errorf("CopyToFolder into %q succeeded", folder)
+		}
+	}
+	if _, err := os.Stat(newPath); err != nil {
+		t.Errorf("Message file gone after refused move: %s", err)
+	}
+
+	// A failing index hook leaves the new path indexed, so the move must
+	// still drop the old one.
+	db.SetIndexHook(func(m *Message, merged bool) { panic("boom") })
+	finalPath, err := moved.MoveToFolder(db, "Trash")
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("MoveToFolder returned %v, want the hook panic", err)
+	}
+	if want := filepath.Join(root, "Trash", "cur", name); finalPath != want {
+		t.Errorf("Message moved to %q, want %s", finalPath, want)
+	}
+	if old, err := db.FindMessageByFilename(newPath); err != nil || old != nil {
+		t.Errorf("Old path still indexed after hook failure: %v, %v", old, err)
+	}
+	if _, err = os.Stat(finalPath); err != nil {
+		t.Errorf("Moved file missing: %s", err)
+	}
+}
+
+func TestCachedCount(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	msg := indexTestMessage(t, db, root, "msg", message)
+	count := func(want int) {
+		n, err := db.CachedCount("*", time.Hour)
+		if err != nil {
+			t.Fatalf("Error in CachedCount: %s", err)
+		}
+		if n != want {
+			t.Errorf("CachedCount = %d, want %d", n, want)
+		}
+	}
+	count(1)
+
+	// Tamper with the cached value to tell it apart from a fresh count.
+	c := db.counts["*"]
+	c.count = 42
+	db.counts["*"] = c
+	count(42)
+
+	if err := msg.AddTag("tag1"); err != nil {
+		t.Fatalf("Error in AddTag: %s", err)
+	}
+	count(1)
+}
+
+func TestFindMessagesByIDs(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	id1 := indexTestMessage(t, db, root, "msg1", message).ID()
+	id2 := indexTestMessage(t, db, root, "msg2", testMessage("other")).ID()
+	msgs, err := db.FindMessagesByIDs([]string{id1, id2, "doesnt-exist"})
+	if err != nil {
+		t.Fatalf("Error in FindMessagesByIDs: %s", err)
+	}
+	if len(msgs) != 2 || msgs[id1] == nil || msgs[id2] == nil {
+		t.Errorf("Invalid messages found: %v", msgs)
+	}
+	if msgs[id2] != nil && msgs[id2].ID() != id2 {
+		t.Errorf("Message for %s has id %s", id2, msgs[id2].ID())
+	}
+}
+
+func TestUint64Property(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	msg := indexTestMessage(t, db, root, "msg", message)
+	if v, ok, err := msg.GetUint64Property("sync.uid"); err != nil || ok {
+		t.Errorf("GetUint64Property of an absent property = %d, %v, %v", v, ok, err)
+	}
+	for _, want := range []uint64{42, 1<<64 - 1} {
+		if err := msg.SetUint64Property("sync.uid", want); err != nil {
+			t.Fatalf("Error in SetUint64Property: %s", err)
+		}
+		v, ok, err := msg.GetUint64Property("sync.uid")
+		if err != nil || !ok || v != want {
+			t.Errorf("GetUint64Property = %d, %v, %v, want %d", v, ok, err, want)
+		}
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	write := func(name, content string) string {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Could not create message dir: %s", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Could not write message: %s", err)
+		}
+		return path
+	}
+	reconcile := func(want ReconcileReport) {
+		report, err := db.Reconcile("", ReconcileOpts{SyncMaildirFlags: true})
+		if err != nil {
+			t.Fatalf("Error in Reconcile: %s", err)
+		}
+		if report != want {
+			t.Errorf("Reconcile report %+v, want %+v", report, want)
+		}
+	}
+
+	// INBOX is a complete maildir from the start, so its tmp/ is skipped.
+	if err := os.MkdirAll(filepath.Join(root, "INBOX", "new"), 0755); err != nil {
+		t.Fatalf("Could not create maildir: %s", err)
+	}
+	unchanged := write("INBOX/cur/unchanged:2,S", message)
+	deleted := write("INBOX/cur/deleted:2,", testMessage("deleted"))
+	write("INBOX/tmp/partial", testMessage("partial"))
+	reconcile(ReconcileReport{Added: 2})
+
+	if err := os.Remove(deleted); err != nil {
+		t.Fatalf("Could not remove message: %s", err)
+	}
+	added := write("INBOX/new/added", testMessage("added"))
+	reconcile(ReconcileReport{Added: 1, Removed: 1})
+
+	for _, tt := range []struct {
+		path    string
+		indexed bool
+	}{{unchanged, true}, {deleted, false}, {added, true}} {
+		msg, err := db.FindMessageByFilename(tt.path)
+		if err != nil {
+			t.Fatalf("Error in FindMessageByFilename: %s", err)
+		}
+		if (msg != nil) != tt.indexed {
+			t.Errorf("%s indexed: %v, want %v", tt.path, msg != nil, tt.indexed)
+		}
+	}
+}
+
+func benchmarkMessages(b *testing.B, n int) (*Database, []string, func()) {
+	root, err := ioutil.TempDir("", "nm-")
+	if err != nil {
+		b.Fatalf("Could not create temp dir: %s", err)
+	}
+	db, err := New(root)
+	if err != nil {
+		os.RemoveAll(root)
+		b.Fatalf("Could not create new notmuch DB: %s", err)
+	}
+	cleanup := func() {
+		db.Close()
+		os.RemoveAll(root)
+	}
+	ids := make([]string, n)
+	for i := range ids {
+		msg, err := db.IndexBytes([]byte(testMessage(fmt.Sprintf("bench%d", i))), nil)
+		if err != nil {
+			cleanup()
+			b.Fatalf("Error in IndexBytes: %s", err)
+		}
+		ids[i] = msg.ID()
+	}
+	return db, ids, cleanup
+}
+
+func BenchmarkSearchMessages(b *testing.B) {
+	db, _, cleanup := benchmarkMessages(b, 500)
+	defer cleanup()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db.searchMessages("*", func(m *Message) error {
+			return nil
+		})
+	}
+}
+
+func BenchmarkFindMessages(b *testing.B) {
+	db, ids, cleanup := benchmarkMessages(b, 500)
+	defer cleanup()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, id := range ids {
+			db.FindMessage(id)
+		}
+	}
+}
+
+func TestHasHeader(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	content := testMessage("msg", "Subject: Some test message\n", "Subject: Some test message\nIn-Reply-To:\n")
+	msg := indexTestMessage(t, db, root, "msg", content)
+	for _, tt := range []struct {
+		name string
+		want bool
+	}{{"Subject", true}, {"In-Reply-To", true}, {"in-reply-to", true}, {"References", false}} {
+		if got := msg.HasHeader(tt.name); got != tt.want {
+			t.Errorf("HasHeader(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBulkMode(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	if err := db.SetBulkMode(true); err != nil {
+		t.Fatalf("Error in SetBulkMode: %s", err)
+	}
+	const n = 50
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("msg%d", i)
+		indexTestMessage(t, db, root, name, testMessage(name))
+		switch i {
+		case 10:
+			// Reopening must not throw away the bulk transaction.
+			if err := db.Refresh(); err != nil {
+				t.Fatalf("Error in Refresh during bulk mode: %s", err)
+			}
+		case 20:
+			calls := 0
+			err := db.WithAtomicRetry(func() error {
+				calls++
+				if calls == 1 {
+					return Error{Code: int(statusXapianException), Detail: "DatabaseModifiedError"}
+				}
+				return nil
+			}, 1)
+			if err != nil || calls != 2 {
+				t.Fatalf("WithAtomicRetry during bulk mode returned %v after %d calls", err, calls)
+			}
+		}
+	}
+	if err := db.SetBulkMode(false); err != nil {
+		t.Fatalf("Error in SetBulkMode: %s", err)
+	}
+	db.Close()
+
+	db, err := Open(root, true)
+	if err != nil {
+		t.Fatalf("Could not open notmuch DB: %s", err)
+	}
+	defer db.Close()
+	count, err := db.countMessages("*")
+	if err != nil {
+		t.Fatalf("Error counting messages: %s", err)
+	}
+	if count != n {
+		t.Errorf("%d messages committed, want %d", count, n)
+	}
+}
+
+func TestClone(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	msg := indexTestMessage(t, db, root, "msg", testMessage("clone"))
+	if err := msg.AddTag("kept"); err != nil {
+		t.Fatalf("Error adding tag: %s", err)
+	}
+	msg.Close()
+
+	var clone *Message
+	err := db.searchMessages("id:clone@example.com", func(m *Message) error {
+		var err error
+		clone, err = m.Clone(db)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Error cloning message: %s", err)
+	}
+	if clone == nil {
+		t.Fatalf("Clone did not find the message")
+	}
+	defer clone.Close()
+	// The search and the message it returned are gone by now.
+	if tags := clone.Tags(); !containsTag(tags, "kept") {
+		t.Errorf("Clone has tags %v, want kept", tags)
+	}
+
+	clone.Close()
+	if _, err := clone.Clone(db); err != ErrMessageClosed {
+		t.Errorf("Clone of a closed message returned %v, want ErrMessageClosed", err)
+	}
+}
+
+func TestIndexHook(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	var calls []bool
+	db.SetIndexHook(func(m *Message, merged bool) {
+		if m.ID() != "hook@example.com" {
+			t.Errorf("Hook got message %q", m.ID())
+		}
+		calls = append(calls, merged)
+	})
+	indexTestMessage(t, db, root, "first", testMessage("hook"))
+	indexTestMessage(t, db, root, "second", testMessage("hook"))
+	if len(calls) != 2 || calls[0] || !calls[1] {
+		t.Errorf("Hook called with merged=%v, want [false true]", calls)
+	}
+
+	db.SetIndexHook(func(m *Message, merged bool) { panic("boom") })
+	path := filepath.Join(root, "third")
+	if err := ioutil.WriteFile(path, []byte(testMessage("panic")), 0600); err != nil {
+		t.Fatalf("Error writing message: %s", err)
+	}
+	msg, err := db.IndexFile(path)
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("IndexFile returned %v, want the hook panic", err)
+	}
+	if msg == nil {
+		t.Errorf("IndexFile did not return the indexed message")
+	}
+}
+
+func TestEmptyQuery(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	indexTestMessage(t, db, root, "a", testMessage("a"))
+	indexTestMessage(t, db, root, "b", testMessage("b"))
+	for _, query := range []string{"", " ", "*"} {
+		n := 0
+		err := db.searchMessages(query, func(*Message) error {
+			n++
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Error searching %q: %s", query, err)
+		}
+		if n != 2 {
+			t.Errorf("Search %q returned %d messages, want 2", query, n)
+		}
+		if count, err := db.CachedCount(query, 0); err != nil || count != 2 {
+			t.Errorf("Count of %q is %d, %v, want 2", query, count, err)
+		}
+	}
+}
+
+func TestChangeLog(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	msg := indexTestMessage(t, db, root, "msg", testMessage("log"))
+	if err := msg.AddTag("old"); err != nil {
+		t.Fatalf("Error adding tag: %s", err)
+	}
+	var log ChangeLog
+	msg.SetChangeLog(&log)
+	if err := msg.Freeze(); err != nil {
+		t.Fatalf("Error freezing message: %s", err)
+	}
+	for _, tag := range []string{"new", "old", "gone"} {
+		if err := msg.AddTag(tag); err != nil {
+			t.Fatalf("Error adding tag: %s", err)
+		}
+	}
+	for _, tag := range []string{"old", "gone"} {
+		if err := msg.RemoveTag(tag); err != nil {
+			t.Fatalf("Error removing tag: %s", err)
+		}
+	}
+	if err := msg.Thaw(); err != nil {
+		t.Fatalf("Error thawing message: %s", err)
+	}
+	if fmt.Sprint(log.Added) != "[new]" || fmt.Sprint(log.Removed) != "[old]" {
+		t.Errorf("Log has added %v, removed %v, want [new] and [old]", log.Added, log.Removed)
+	}
+}
+
+func TestExportArchive(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	msg := indexTestMessage(t, db, root, "msg", testMessage("export"))
+	if err := msg.AddTag("to do"); err != nil {
+		t.Fatalf("Error adding tag: %s", err)
+	}
+	indexTestMessage(t, db, root, "other", testMessage("other"))
+
+	var buf bytes.Buffer
+	if err := db.ExportArchive(&buf, "id:export@example.com"); err != nil {
+		t.Fatalf("Error exporting archive: %s", err)
+	}
+	entries := make(map[string]string)
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error reading archive: %s", err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("Error reading archive: %s", err)
+		}
+		entries[hdr.Name] = string(data)
+	}
+	if len(entries) != 2 {
+		t.Errorf("Archive has entries %v, want mail/msg and dump", entries)
+	}
+	if entries["mail/msg"] != testMessage("export") {
+		t.Errorf("Archived message is %q", entries["mail/msg"])
+	}
+	if want := "+to%20do -- id:export@example.com\n"; entries["dump"] != want {
+		t.Errorf("Dump is %q, want %q", entries["dump"], want)
+	}
+
+	// IDs are written as boolean terms, not hex escaped like tags.
+	for id, want := range map[string]string{
+		"a/b!c&d$e@example.com":    "id:a/b!c&d$e@example.com",
+		`odd "id" (x)@example.com`: `id:"odd ""id"" (x)@example.com"`,
+	} {
+		term := dumpIDTerm(id)
+		if term != want {
+			t.Errorf("dumpIDTerm(%q) = %q, want %q", id, term, want)
+		}
+		if got, err := parseDumpID(strings.TrimPrefix(term, "id:")); err != nil || got != id {
+			t.Errorf("parseDumpID(%q) = %q, %v, want %q", term, got, err, id)
+		}
+	}
+}
+
+func TestImportArchive(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	msg := indexTestMessage(t, db, root, "cur/msg:2,S", testMessage("import"))
+	for _, tag := range []string{"to do", "work"} {
+		if err := msg.AddTag(tag); err != nil {
+			t.Fatalf("Error adding tag: %s", err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := db.ExportArchive(&buf, "*"); err != nil {
+		t.Fatalf("Error exporting archive: %s", err)
+	}
+
+	dest, destRoot, destCleanup := newTestDB(t)
+	defer destCleanup()
+	archive := buf.Bytes()
+	for _, bad := range []string{"..", ".notmuch", filepath.Dir(destRoot)} {
+		if _, err := dest.ImportArchive(bytes.NewReader(archive), bad); err == nil {
+			t.Errorf("ImportArchive into %s succeeded", bad)
+		}
+	}
+	n, err := dest.ImportArchive(bytes.NewReader(archive), "imported")
+	if err != nil {
+		t.Fatalf("Error importing archive: %s", err)
+	}
+	if n != 1 {
+		t.Errorf("Imported %d messages, want 1", n)
+	}
+	imported, err := dest.FindMessage("import@example.com")
+	if err != nil || imported == nil {
+		t.Fatalf("Imported message not found: %v", err)
+	}
+	if want := filepath.Join(destRoot, "imported", "cur", "msg:2,S"); imported.FileName() != want {
+		t.Errorf("Imported message is at %s, want %s", imported.FileName(), want)
+	}
+	if tags := imported.Tags(); fmt.Sprint(tags) != "[to do work]" {
+		t.Errorf("Imported message has tags %v, want [to do work]", tags)
+	}
+
+	// Entries must not end up in the private directory of the database.
+	var evil bytes.Buffer
+	tw := tar.NewWriter(&evil)
+	for _, f := range []struct{ name, content string }{
+		{"mail/.notmuch/msg", testMessage("evil")},
+		{"dump", "+inbox -- id:evil@example.com\n"},
+	} {
+		hdr := &tar.Header{Name: f.name, Mode: 0600, Size: int64(len(f.content)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("Error writing archive: %s", err)
+		}
+		if _, err := tw.Write([]byte(f.content)); err != nil {
+			t.Fatalf("Error writing archive: %s", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Error writing archive: %s", err)
+	}
+	if _, err := dest.ImportArchive(&evil, ""); err == nil {
+		t.Errorf("ImportArchive wrote into .notmuch")
+	}
+	if _, err := os.Stat(filepath.Join(destRoot, ".notmuch", "msg")); !os.IsNotExist(err) {
+		t.Errorf("Archive entry written into .notmuch: %v", err)
+	}
+}
+
+func TestCompactInPlace(t *testing.T) {
+	if !BuiltWith("compact") {
+		t.Skip("libnotmuch built without compaction support")
+	}
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	msg := indexTestMessage(t, db, root, "msg", testMessage("compact"))
+	if err := msg.AddTag("kept"); err != nil {
+		t.Fatalf("Error adding tag: %s", err)
+	}
+	msg.Close()
+	dir, err := db.Directory("")
+	if err != nil || dir == nil {
+		t.Fatalf("Error in Directory: %v", err)
+	}
+	var progress []string
+	if err := db.CompactInPlace(func(s string) { progress = append(progress, s) }); err != nil {
+		t.Fatalf("Error in CompactInPlace: %s", err)
+	}
+	if len(progress) == 0 {
+		t.Errorf("No progress reported")
+	}
+	// Directories from the replaced handle count as closed.
+	if err := dir.SetMTime(time.Now()); err != ErrDatabaseClosed {
+		t.Errorf("SetMTime after compacting returned %v, want ErrDatabaseClosed", err)
+	}
+	if mtime := dir.MTime(); !mtime.IsZero() {
+		t.Errorf("MTime after compacting returned %s", mtime)
+	}
+	if _, err := os.Stat(filepath.Join(root, ".notmuch", "xapian.old")); !os.IsNotExist(err) {
+		t.Errorf("Backup left behind: %v", err)
+	}
+
+	msg, err = db.FindMessage("compact@example.com")
+	if err != nil || msg == nil {
+		t.Fatalf("Message not found after compacting: %v", err)
+	}
+	if !msg.HasTag("kept") {
+		t.Errorf("Message lost its tags")
+	}
+	db.Close()
+
+	db, err = Open(root, true)
+	if err != nil {
+		t.Fatalf("Could not open compacted DB: %s", err)
+	}
+	db.Close()
+}
+
+func TestSnippet(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	msg := indexTestMessage(t, db, root, "msg", message)
+	snippet, err := msg.Snippet(0)
+	if err != nil {
+		t.Fatalf("Error in Snippet: %s", err)
+	}
+	if snippet != "This is some very sample message." {
+		t.Errorf("Snippet is %q", snippet)
+	}
+	if snippet, _ := msg.Snippet(7); snippet != "This is" {
+		t.Errorf("Snippet(7) is %q", snippet)
+	}
+
+	alternative := strings.Replace(testMessage("alt"), "Content-Type: text/plain; charset=utf-8",
+		`Content-Type: multipart/alternative; boundary="b"`, 1)
+	alternative = strings.Replace(alternative, "This is some very sample message.\n",
+		"--b\nContent-Type: text/html\n\n<p>HTML</p>\n--b\n"+
+			"Content-Type: text/plain\nContent-Transfer-Encoding: quoted-printable\n\n"+
+			"Plain =\ntext.\nOn Monday, someone wrote:\n> quoted\n--b--\n", 1)
+	msg = indexTestMessage(t, db, root, "alt", alternative)
+	if snippet, err := msg.Snippet(0); err != nil || snippet != "Plain text." {
+		t.Errorf("Snippet of multipart/alternative is %q, %v", snippet, err)
+	}
+}
+
+func TestForEachMessageFile(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	indexTestMessage(t, db, root, "a", testMessage("dup"))
+	indexTestMessage(t, db, root, "b", testMessage("dup"))
+	indexTestMessage(t, db, root, "c", testMessage("other"))
+	var files []string
+	err := db.ForEachMessageFile("id:dup@example.com", func(id, path string) error {
+		if id != "dup@example.com" {
+			t.Errorf("Got file of message %q", id)
+		}
+		files = append(files, filepath.Base(path))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error in ForEachMessageFile: %s", err)
+	}
+	sort.Strings(files)
+	if fmt.Sprint(files) != "[a b]" {
+		t.Errorf("Visited files %v, want [a b]", files)
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err = db.ForEachMessageFile("*", func(id, path string) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Errorf("ForEachMessageFile returned %v after %d calls, want stop after 1", err, calls)
+	}
+}
+
+func TestRestoreTags(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	msg := indexTestMessage(t, db, root, "msg", testMessage("snapshot"))
+	for _, tag := range []string{"a", "b"} {
+		if err := msg.AddTag(tag); err != nil {
+			t.Fatalf("Error adding tag: %s", err)
+		}
+	}
+	snapshot := msg.SnapshotTags()
+	if err := msg.RemoveTag("a"); err != nil {
+		t.Fatalf("Error removing tag: %s", err)
+	}
+	if err := msg.AddTag("c"); err != nil {
+		t.Fatalf("Error adding tag: %s", err)
+	}
+	if err := msg.RestoreTags(snapshot); err != nil {
+		t.Fatalf("Error in RestoreTags: %s", err)
+	}
+	if tags := msg.Tags(); fmt.Sprint(tags) != "[a b]" {
+		t.Errorf("Restored tags are %v, want [a b]", tags)
+	}
+}
+
+func TestSetMode(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+	indexTestMessage(t, db, root, "msg", testMessage("mode"))
+	db.Close()
+
+	db, err := Open(root, true)
+	if err != nil {
+		t.Fatalf("Could not open notmuch DB: %s", err)
+	}
+	defer db.Close()
+	msg, err := db.FindMessage("mode@example.com")
+	if err != nil || msg == nil {
+		t.Fatalf("Message not found: %v", err)
+	}
+	if err := msg.AddTag("early"); err == nil {
+		t.Errorf("AddTag succeeded on a read-only database")
+	}
+	if err := db.SetMode(false); err != nil {
+		t.Fatalf("Error switching to read-write: %s", err)
+	}
+	if msg, err = db.FindMessage("mode@example.com"); err != nil || msg == nil {
+		t.Fatalf("Message not found after promotion: %v", err)
+	}
+	if err := msg.AddTag("promoted"); err != nil {
+		t.Fatalf("Error adding tag after promotion: %s", err)
+	}
+	if err := db.SetMode(true); err != nil {
+		t.Fatalf("Error switching to read-only: %s", err)
+	}
+
+	db2, err := Open(root, false)
+	if err != nil {
+		t.Fatalf("Could not open notmuch DB for writing after demotion: %s", err)
+	}
+	defer db2.Close()
+	msg2, err := db2.FindMessage("mode@example.com")
+	if err != nil || msg2 == nil {
+		t.Fatalf("Message not found: %v", err)
+	}
+	if !msg2.HasTag("promoted") {
+		t.Errorf("Tag added after promotion was not written")
+	}
+}
+
+func TestIsManagedPath(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	for path, want := range map[string]bool{
+		filepath.Join(root, "cur", "msg"): true,
+		"cur/msg":                         true,
+		root:                              false,
+		filepath.Join(root, ".notmuch", "xapian"): false,
+		filepath.Join(root, "..", "elsewhere"):    false,
+		"../elsewhere":                            false,
+	} {
+		if ok, err := db.IsManagedPath(path); err != nil || ok != want {
+			t.Errorf("IsManagedPath(%q) = %v, %v, want %v", path, ok, err, want)
+		}
+	}
+
+	outside, err := ioutil.TempDir("", "nm-outside-")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(outside)
+	path := filepath.Join(outside, "msg")
+	if err := ioutil.WriteFile(path, []byte(message), 0644); err != nil {
+		t.Fatalf("Could not write message: %s", err)
+	}
+	db.SetStrictPaths(true)
+	if _, err := db.IndexFile(path); err == nil || !strings.Contains(err.Error(), "outside the database root") {
+		t.Errorf("IndexFile of an unmanaged path returned %v", err)
+	}
+	if _, err := db.RemoveMessage(path); err == nil || !strings.Contains(err.Error(), "outside the database root") {
+		t.Errorf("RemoveMessage of an unmanaged path returned %v", err)
+	}
+}
+
+func TestCopyToFolder(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	name := "1519596000.M1P1.host:2,S"
+	msg := indexTestMessage(t, db, root, "INBOX/cur/"+name, message)
+	if err := msg.AddTag("tag1"); err != nil {
+		t.Fatalf("Error in AddTag: %s", err)
+	}
+	copied, err := msg.CopyToFolder(db, "Archive")
+	if err != nil {
+		t.Fatalf("Error in CopyToFolder: %s", err)
+	}
+	if n := copied.CountFiles(); n != 2 {
+		t.Errorf("Message has %d files after copying, want 2", n)
+	}
+	if !copied.HasTag("tag1") {
+		t.Errorf("Copied message lost its tags")
+	}
+	data, err := ioutil.ReadFile(filepath.Join(root, "Archive", "cur", name))
+	if err != nil || string(data) != message {
+		t.Errorf("Copy has content %q, %v", data, err)
+	}
+	if _, err := msg.CopyToFolder(db, "Archive"); err == nil {
+		t.Errorf("Copying over an existing file succeeded")
+	}
+}
+
+func TestMessageRevision(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	msg := indexTestMessage(t, db, root, "msg", testMessage("rev"))
+	before, err := db.MessageRevision("rev@example.com")
+	if err != nil {
+		t.Fatalf("Error in MessageRevision: %s", err)
+	}
+	if err := msg.AddTag("changed"); err != nil {
+		t.Fatalf("Error adding tag: %s", err)
+	}
+	after, err := db.MessageRevision("rev@example.com")
+	if err != nil {
+		t.Fatalf("Error in MessageRevision: %s", err)
+	}
+	if after <= before {
+		t.Errorf("Revision went from %d to %d after tagging", before, after)
+	}
+	if _, err := db.MessageRevision("missing@example.com"); err == nil {
+		t.Errorf("MessageRevision of a missing message succeeded")
+	}
+}
+
+func TestRootPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nm-")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	real := filepath.Join(dir, "real")
+	link := filepath.Join(dir, "link")
+	if err := os.Mkdir(real, 0755); err != nil {
+		t.Fatalf("Could not create dir: %s", err)
+	}
+	if err := os.Symlink(real, link); err != nil {
+		t.Skipf("Could not create symlink: %s", err)
+	}
+	db, err := New(link)
+	if err != nil {
+		t.Fatalf("Could not create notmuch DB: %s", err)
+	}
+	indexTestMessage(t, db, db.RootPath(), "msg", message)
+	db.Close()
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Could not get working directory: %s", err)
+	}
+	defer os.Chdir(cwd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("Could not change directory: %s", err)
+	}
+	db, err = Open("link", true)
+	if err != nil {
+		t.Fatalf("Could not open notmuch DB through a relative symlink: %s", err)
+	}
+	defer db.Close()
+	want, err := filepath.EvalSymlinks(real)
+	if err != nil {
+		t.Fatalf("Could not resolve dir: %s", err)
+	}
+	if db.RootPath() != want || db.Path() != want {
+		t.Errorf("Root is %q, path %q, want %q", db.RootPath(), db.Path(), want)
+	}
+	msg, err := db.FindMessageByFilename(filepath.Join(db.RootPath(), "msg"))
+	if err != nil || msg == nil {
+		t.Errorf("Message not found by filename: %v, %v", msg, err)
+	}
+}
+
+func TestIndexedAt(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	start := time.Now().Truncate(time.Second)
+	msg := indexTestMessage(t, db, root, "msg", testMessage("indexed"))
+	at, ok, err := msg.IndexedAt()
+	if err != nil || !ok {
+		t.Fatalf("IndexedAt returned %v, %v", ok, err)
+	}
+	if at.Before(start) || at.After(time.Now()) {
+		t.Errorf("IndexedAt is %s, want between %s and now", at, start)
+	}
+}
+
+func TestUpdateDirectoryMTimes(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	indexTestMessage(t, db, root, "INBOX/cur/a", testMessage("a"))
+	indexTestMessage(t, db, root, "Archive/cur/b", testMessage("b"))
+	past := time.Now().Add(-time.Hour)
+	if err := os.Mkdir(filepath.Join(root, "INBOX", "new"), 0755); err != nil {
+		t.Fatalf("Could not create dir: %s", err)
+	}
+	var dirs []string
+	for _, dir := range []string{"", "INBOX", "INBOX/cur", "INBOX/new", "Archive", "Archive/cur"} {
+		path := filepath.Join(root, dir)
+		if err := os.Chtimes(path, past, past); err != nil {
+			t.Fatalf("Could not set mtime: %s", err)
+		}
+		dirs = append(dirs, path)
+	}
+
+	n, err := db.UpdateDirectoryMTimes("")
+	if err != nil {
+		t.Fatalf("Error in UpdateDirectoryMTimes: %s", err)
+	}
+	if n != len(dirs) {
+		t.Errorf("Updated %d directories, want %d", n, len(dirs))
+	}
+	for _, path := range dirs {
+		dir, err := db.Directory(path)
+		if err != nil {
+			t.Fatalf("Error in Directory: %s", err)
+		}
+		if needs, err := dir.NeedsScan(); err != nil || needs {
+			t.Errorf("NeedsScan(%s) = %v, %v after updating mtimes", path, needs, err)
+		}
+	}
+	if n, err := db.UpdateDirectoryMTimes(""); err != nil || n != 0 {
+		t.Errorf("Second UpdateDirectoryMTimes updated %d, %v, want 0", n, err)
+	}
+}
+
+func TestCount(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	for _, id := range []string{"a", "b", "c"} {
+		indexTestMessage(t, db, root, id, testMessage(id))
+	}
+	for query, want := range map[string]int{"*": 3, "": 3, "tag:none": 0, "id:b@example.com": 1} {
+		if n, err := db.Count(query); err != nil || n != want {
+			t.Errorf("Count(%q) = %d, %v, want %d", query, n, err, want)
+		}
+	}
+}
+
+func TestHooksPath(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	path, err := db.HooksPath()
+	if err != nil {
+		t.Fatalf("Error in HooksPath: %s", err)
+	}
+	if want := filepath.Join(root, ".notmuch", "hooks"); path != want {
+		t.Errorf("Default hooks path is %s, want %s", path, want)
+	}
+	if err := db.SetConfig("database.hook_dir", "/etc/notmuch/hooks"); err != nil {
+		t.Fatalf("Error in SetConfig: %s", err)
+	}
+	if path, err := db.HooksPath(); err != nil || path != "/etc/notmuch/hooks" {
+		t.Errorf("Configured hooks path is %s, %v", path, err)
+	}
+}
+
+func TestSameContentAs(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	msg := indexTestMessage(t, db, root, "msg", message)
+	for content, want := range map[string]bool{
+		message:                        true,
+		"X-Label: changed\n" + message: false,
+		message + "More text.\n":       false,
+	} {
+		// Copies with the same message ID would be merged, so each goes into
+		// a replica of its own.
+		replica, replicaRoot, replicaCleanup := newTestDB(t)
+		copy := indexTestMessage(t, replica, replicaRoot, "copy", content)
+		if same, err := msg.SameContentAs(copy); err != nil || same != want {
+			t.Errorf("SameContentAs(%q) = %v, %v, want %v", content, same, err, want)
+		}
+		replicaCleanup()
+	}
+}
+
+func TestPruneEmptyDirectories(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	indexTestMessage(t, db, root, "Old/cur/a", testMessage("a"))
+	indexTestMessage(t, db, root, "INBOX/cur/b", testMessage("b"))
+	if _, err := db.RemoveMessage(filepath.Join(root, "Old", "cur", "a")); err != nil {
+		t.Fatalf("Error in RemoveMessage: %s", err)
+	}
+	n, err := db.PruneEmptyDirectories()
+	if err != nil {
+		t.Fatalf("Error in PruneEmptyDirectories: %s", err)
+	}
+	if n != 2 {
+		t.Errorf("Pruned %d directories, want 2", n)
+	}
+	rootDir, err := db.Directory(root)
+	if err != nil || rootDir == nil {
+		t.Fatalf("Root directory gone: %v", err)
+	}
+	if dirs := rootDir.ChildDirectories(); fmt.Sprint(dirs) != "[INBOX]" {
+		t.Errorf("Root has subdirectories %v after pruning, want [INBOX]", dirs)
+	}
+}
+
+func TestGetPropertyAll(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	msg := indexTestMessage(t, db, root, "msg", testMessage("props"))
+	for _, kv := range [][2]string{{"key", "b"}, {"key", "a"}, {"key", "c"}, {"key2", "x"}, {"ke", "y"}} {
+		if err := msg.AddProperty(kv[0], kv[1]); err != nil {
+			t.Fatalf("Error in AddProperty: %s", err)
+		}
+	}
+	values, err := msg.GetPropertyAll("key")
+	if err != nil {
+		t.Fatalf("Error in GetPropertyAll: %s", err)
+	}
+	if fmt.Sprint(values) != "[a b c]" {
+		t.Errorf("GetPropertyAll returned %v, want [a b c]", values)
+	}
+	if values, err := msg.GetPropertyAll("missing"); err != nil || len(values) != 0 {
+		t.Errorf("GetPropertyAll of a missing key returned %v, %v", values, err)
+	}
+}
+
+func TestWithAtomicRetry(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	indexTestMessage(t, db, root, "msg", testMessage("retry")).Close()
+	modified := Error{
+		Code:   int(statusXapianException),
+		Detail: "The revision being read has been discarded - you should call Xapian::Database::reopen() and retry the operation",
+	}
+	calls := 0
+	err := db.WithAtomicRetry(func() error {
+		calls++
+		if calls == 1 {
+			return modified
+		}
+		// Messages must be looked up again after the refresh.
+		msg, err := db.FindMessage("retry@example.com")
+		if err != nil {
+			return err
+		}
+		return msg.AddTag("retried")
+	}, 3)
+	if err != nil || calls != 2 {
+		t.Errorf("WithAtomicRetry returned %v after %d calls, want success after 2", err, calls)
+	}
+	msg, err := db.FindMessage("retry@example.com")
+	if err != nil {
+		t.Fatalf("Error in FindMessage: %s", err)
+	}
+	if !msg.HasTag("retried") {
+		t.Errorf("Retried change was not applied")
+	}
+
+	calls = 0
+	err = db.WithAtomicRetry(func() error {
+		calls++
+		return modified
+	}, 2)
+	if err == nil || calls != 3 {
+		t.Errorf("WithAtomicRetry returned %v after %d calls, want the error after 3", err, calls)
+	}
+
+	calls = 0
+	other := errors.New("other")
+	err = db.WithAtomicRetry(func() error {
+		calls++
+		return other
+	}, 2)
+	if err != other || calls != 1 {
+		t.Errorf("WithAtomicRetry returned %v after %d calls, want other after 1", err, calls)
+	}
+}
+
+func TestWithAtomicRetryModified(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	indexTestMessage(t, db, root, "msg", testMessage("modified")).Close()
+	reader, err := Open(root, true)
+	if err != nil {
+		t.Fatalf("Could not open notmuch DB: %s", err)
+	}
+	defer reader.Close()
+	if ok, err := reader.MessageExists("modified@example.com"); err != nil || !ok {
+		t.Fatalf("Message not found by reader: %v, %v", ok, err)
+	}
+
+	// Commit enough revisions for the one the reader holds to be discarded.
+	for i := 0; i < 50; i++ {
+		err := db.WithAtomicRetry(func() error {
+			path := filepath.Join(root, fmt.Sprintf("msg%d", i))
+			if err := ioutil.WriteFile(path, []byte(testMessage(fmt.Sprint("modified", i))), 0600); err != nil {
+				return err
+			}
+			msg, err := db.IndexFile(path)
+			if msg != nil {
+				msg.Close()
+			}
+			return err
+		}, 0)
+		if err != nil {
+			t.Fatalf("Error indexing: %s", err)
+		}
+	}
+
+	var first error
+	calls := 0
+	err = reader.WithAtomicRetry(func() error {
+		calls++
+		_, err := reader.MessageExists("modified49@example.com")
+		if calls == 1 {
+			first = err
+		}
+		return err
+	}, 1)
+	if calls == 1 && err == nil {
+		t.Skip("The reader's revision was not discarded")
+	}
+	if err != nil {
+		t.Fatalf("WithAtomicRetry returned %v after %d calls", err, calls)
+	}
+	if !isModifiedError(first) {
+		t.Errorf("First attempt failed with %v, want a DatabaseModifiedError", first)
+	}
+}
+
+func TestHeadersFor(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	msg := indexTestMessage(t, db, root, "msg", message)
+	headers, err := msg.HeadersFor([]string{"Delivered-To", "Subject", "List-Id"})
+	if err != nil {
+		t.Fatalf("Error in HeadersFor: %s", err)
+	}
+	want := map[string]string{"Delivered-To": "test@example.com", "Subject": "Some test message"}
+	if fmt.Sprint(headers) != fmt.Sprint(want) {
+		t.Errorf("HeadersFor returned %v, want %v", headers, want)
+	}
+	headers, err = msg.Headers()
+	if err != nil {
+		t.Fatalf("Error in Headers: %s", err)
+	}
+	if _, ok := headers["Delivered-To"]; ok || headers["From"] != "Sample Message <return@example.com>" {
+		t.Errorf("Headers returned %v", headers)
+	}
+}
+
+func TestThreadSize(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	first := indexTestMessage(t, db, root, "first", testMessage("first"))
+	reply := indexTestMessage(t, db, root, "reply", testMessage("reply",
+		"Subject: Some test message\n", "Subject: Some test message\nIn-Reply-To: <first@example.com>\n"))
+	indexTestMessage(t, db, root, "other", testMessage("other"))
+	if first.ThreadID() != reply.ThreadID() {
+		t.Fatalf("Reply is in thread %s, want %s", reply.ThreadID(), first.ThreadID())
+	}
+	if total, matched, err := db.ThreadSize(first.ThreadID()); err != nil || total != 2 || matched != 2 {
+		t.Errorf("ThreadSize = %d, %d, %v, want 2, 2", total, matched, err)
+	}
+
+	if err := db.SetConfigValues("search.exclude_tags", []string{"deleted"}); err != nil {
+		t.Fatalf("Error in SetConfigValues: %s", err)
+	}
+	if err := reply.AddTag("deleted"); err != nil {
+		t.Fatalf("Error in AddTag: %s", err)
+	}
+	if total, matched, err := db.ThreadSize(first.ThreadID()); err != nil || total != 2 || matched != 1 {
+		t.Errorf("ThreadSize with an excluded reply = %d, %d, %v, want 2, 1", total, matched, err)
+	}
+}
+
+func TestDeleteFromDisk(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	msg := indexTestMessage(t, db, root, "cur/a", testMessage("dup"))
+	indexTestMessage(t, db, root, "cur/b", testMessage("dup"))
+	if gone, err := msg.DeleteFromDisk(db); err != nil || gone {
+		t.Errorf("Deleting the first of two files returned %v, %v", gone, err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "cur", "a")); !os.IsNotExist(err) {
+		t.Errorf("First file still exists: %v", err)
+	}
+
+	msg, err := db.FindMessage("dup@example.com")
+	if err != nil || msg == nil {
+		t.Fatalf("Message not found: %v", err)
+	}
+	if gone, err := msg.DeleteFromDisk(db); err != nil || !gone {
+		t.Errorf("Deleting the last file returned %v, %v", gone, err)
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(root, "cur"))
+	if err != nil || len(entries) != 0 {
+		t.Errorf("Directory still has %d entries, %v", len(entries), err)
+	}
+	if exists, err := db.MessageExists("dup@example.com"); err != nil || exists {
+		t.Errorf("Message still indexed: %v, %v", exists, err)
+	}
+}
+
+func TestSetDefaultDecryptPolicy(t *testing.T) {
+	db, _, cleanup := newTestDB(t)
+	defer cleanup()
+
+	for _, policy := range []DecryptPolicy{DecryptNoStash, DecryptTrue, DecryptAuto, DecryptFalse} {
+		if err := db.SetDefaultDecryptPolicy(policy); err != nil {
+			t.Fatalf("Error in SetDefaultDecryptPolicy(%s): %s", policy, err)
+		}
+		if value, err := db.GetConfig("index.decrypt"); err != nil || value != policy.String() {
+			t.Errorf("index.decrypt is %q, %v after setting %s", value, err, policy)
+		}
+	}
+	if err := db.SetDefaultDecryptPolicy(DecryptPolicy(42)); err == nil {
+		t.Errorf("SetDefaultDecryptPolicy accepted an invalid policy")
+	}
+}
+
+func TestNewTemp(t *testing.T) {
+	db, cleanup, err := NewTemp()
+	if err != nil {
+		t.Fatalf("Error in NewTemp: %s", err)
+	}
+	root := db.RootPath()
+	indexTestMessage(t, db, root, "msg", testMessage("temp"))
+	if n, err := db.Count("id:temp@example.com"); err != nil || n != 1 {
+		t.Errorf("Count in temp DB = %d, %v, want 1", n, err)
+	}
+	cleanup()
+	if _, err := os.Stat(root); !os.IsNotExist(err) {
+		t.Errorf("Temp DB directory still exists: %v", err)
+	}
+	if _, err := db.Count("*"); err != ErrDatabaseClosed {
+		t.Errorf("Count after cleanup returned %v, want ErrDatabaseClosed", err)
+	}
+}
+
+func TestRawHeaders(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	msg := indexTestMessage(t, db, root, "a", message)
+	indexTestMessage(t, db, root, "b", message)
+	h, err := msg.RawHeaders()
+	if err != nil {
+		t.Fatalf("Error in RawHeaders: %s", err)
+	}
+	if got := h.Get("Return-Path"); got != "<return@example.com>" {
+		t.Errorf("Return-Path is %q", got)
+	}
+
+	// The headers are still found with the primary file gone.
+	if err := os.Remove(msg.FileName()); err != nil {
+		t.Fatalf("Could not remove file: %s", err)
+	}
+	if h, err := msg.RawHeaders(); err != nil || h.Get("Delivered-To") != "test@example.com" {
+		t.Errorf("RawHeaders without the primary file returned %v, %v", h, err)
+	}
+}
+
+func TestReconcileReadOnly(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+	indexTestMessage(t, db, root, "INBOX/cur/msg", message)
+	if err := db.SetMode(true); err != nil {
+		t.Fatalf("Error in SetMode: %s", err)
+	}
+	// Unindexed directories have no document a read-only handle could return.
+	if err := os.Mkdir(filepath.Join(root, "Unknown"), 0755); err != nil {
+		t.Fatalf("Could not create dir: %s", err)
+	}
+	if _, err := db.Reconcile("", ReconcileOpts{}); err == nil {
+		t.Errorf("Reconcile succeeded on a read-only database")
+	}
+	if _, err := db.UpdateDirectoryMTimes(""); err == nil {
+		t.Errorf("UpdateDirectoryMTimes succeeded on a read-only database")
+	}
+}
+
+func TestDirectoryClosed(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	indexTestMessage(t, db, root, "INBOX/cur/msg", message)
+	deleted, err := db.Directory("Empty")
+	if err != nil || deleted == nil {
+		t.Fatalf("Error in Directory: %v", err)
+	}
+	if err := deleted.Delete(); err != nil {
+		t.Fatalf("Error in Delete: %s", err)
+	}
+	if err := deleted.Delete(); err != ErrDatabaseClosed {
+		t.Errorf("Second Delete returned %v, want ErrDatabaseClosed", err)
+	}
+	if files := deleted.ChildFiles(); files != nil {
+		t.Errorf("ChildFiles after Delete returned %v", files)
+	}
+
+	dir, err := db.Directory("INBOX/cur")
+	if err != nil || dir == nil {
+		t.Fatalf("Error in Directory: %v", err)
+	}
+	db.Close()
+	if mtime := dir.MTime(); !mtime.IsZero() {
+		t.Errorf("MTime after closing the database returned %s", mtime)
+	}
+	if dirs := dir.ChildDirectories(); dirs != nil {
+		t.Errorf("ChildDirectories after closing the database returned %v", dirs)
+	}
+	if err := dir.SetMTime(time.Now()); err != ErrDatabaseClosed {
+		t.Errorf("SetMTime after closing the database returned %v, want ErrDatabaseClosed", err)
+	}
+}
+
+// Drain ms and return the IDs of its messages, sorted.
+func drainIDs(t *testing.T, ms *Messages) []string {
+	var ids []string
+	for {
+		msg, err := ms.Next()
+		if err != nil {
+			t.Fatalf("Error in Next: %s", err)
+		}
+		if msg == nil {
+			break
+		}
+		ids = append(ids, msg.ID())
+		msg.Close()
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestQuery(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	indexTestMessage(t, db, root, "a", testMessage("a")).Close()
+	indexTestMessage(t, db, root, "b", testMessage("b")).Close()
+	q, err := db.NewQuery("*")
+	if err != nil {
+		t.Fatalf("Error in NewQuery: %s", err)
+	}
+	if n, err := q.CountMessages(); err != nil || n != 2 {
+		t.Errorf("CountMessages = %d, %v, want 2", n, err)
+	}
+	ms, err := q.SearchMessages()
+	if err != nil {
+		t.Fatalf("Error in SearchMessages: %s", err)
+	}
+	if ids := drainIDs(t, ms); fmt.Sprint(ids) != "[a@example.com b@example.com]" {
+		t.Errorf("Search found %v", ids)
+	}
+
+	ms, err = q.SearchMessages()
+	if err != nil {
+		t.Fatalf("Error in SearchMessages: %s", err)
+	}
+	msg, err := ms.Next()
+	if err != nil || msg == nil {
+		t.Fatalf("Next = %v, %v", msg, err)
+	}
+	q.Close()
+	q.Close()
+	if _, err := q.SearchMessages(); err != ErrQueryClosed {
+		t.Errorf("SearchMessages after Close returned %v, want ErrQueryClosed", err)
+	}
+	if _, err := ms.Next(); err != ErrQueryClosed {
+		t.Errorf("Next after closing the query returned %v, want ErrQueryClosed", err)
+	}
+	if err := msg.AddTag("tag1"); err != ErrMessageClosed {
+		t.Errorf("AddTag after closing the query returned %v, want ErrMessageClosed", err)
+	}
+	msg.Close()
+	ms.Close()
+
+	q, err = db.NewQuery("*")
+	if err != nil {
+		t.Fatalf("Error in NewQuery: %s", err)
+	}
+	db.Close()
+	if _, err := q.CountMessages(); err != ErrDatabaseClosed {
+		t.Errorf("CountMessages after closing the database returned %v, want ErrDatabaseClosed", err)
+	}
+	q.Close()
+}
+
+func TestApplyConfiguredExcludes(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	indexTestMessage(t, db, root, "a", testMessage("a")).Close()
+	spam := indexTestMessage(t, db, root, "b", testMessage("b"))
+	if err := spam.AddTag("spam"); err != nil {
+		t.Fatalf("Error adding tag: %s", err)
+	}
+	if err := db.SetConfigValues("search.exclude_tags", []string{"spam", "deleted"}); err != nil {
+		t.Fatalf("Error in SetConfigValues: %s", err)
+	}
+
+	search := func(query string) []string {
+		q, err := db.NewQueryRaw(query)
+		if err != nil {
+			t.Fatalf("Error in NewQueryRaw: %s", err)
+		}
+		defer q.Close()
+		if err := q.ApplyConfiguredExcludes(db); err != nil {
+			t.Fatalf("Error in ApplyConfiguredExcludes: %s", err)
+		}
+		ms, err := q.SearchMessages()
+		if err != nil {
+			t.Fatalf("Error in SearchMessages: %s", err)
+		}
+		return drainIDs(t, ms)
+	}
+	if ids := search("*"); fmt.Sprint(ids) != "[a@example.com]" {
+		t.Errorf("Search with excludes found %v, want [a@example.com]", ids)
+	}
+	// Searching for an excluded tag explicitly still finds it.
+	if ids := search("tag:spam"); fmt.Sprint(ids) != "[b@example.com]" {
+		t.Errorf("Search for an excluded tag found %v, want [b@example.com]", ids)
+	}
+}
+
+func TestQueryReuse(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	for _, id := range []string{"a", "b", "c"} {
+		indexTestMessage(t, db, root, id, testMessage(id)).Close()
+	}
+	q, err := db.NewQuery("*")
+	if err != nil {
+		t.Fatalf("Error in NewQuery: %s", err)
+	}
+	defer q.Close()
+	n, err := q.CountMessages()
+	if err != nil {
+		t.Fatalf("Error in CountMessages: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		ms, err := q.SearchMessages()
+		if err != nil {
+			t.Fatalf("Error in SearchMessages: %s", err)
+		}
+		if ids := drainIDs(t, ms); len(ids) != n || n != 3 {
+			t.Errorf("Search %d found %v, count was %d", i, ids, n)
+		}
+		ms.Close()
+	}
+	if n, err := q.CountMessages(); err != nil || n != 3 {
+		t.Errorf("CountMessages after searching = %d, %v, want 3", n, err)
+	}
+}
+
+func TestMessagesInFolder(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	indexTestMessage(t, db, root, "Work/cur/a:2,", testMessage("a")).Close()
+	indexTestMessage(t, db, root, "Work/Old \"x\"/new/b", testMessage("b")).Close()
+	indexTestMessage(t, db, root, "cur/c:2,", testMessage("c")).Close()
+
+	for _, c := range []struct {
+		folder bool
+		arg    string
+		want   string
+	}{
+		{true, "Work", "[a@example.com]"},
+		{true, `Work/Old "x"`, "[b@example.com]"},
+		{true, "", "[c@example.com]"},
+		{false, "Work", "[a@example.com b@example.com]"},
+		{false, "Work/cur", "[a@example.com]"},
+		{false, "", "[a@example.com b@example.com c@example.com]"},
+	} {
+		search, name := db.MessagesUnderPath, "MessagesUnderPath"
+		if c.folder {
+			search, name = db.MessagesInFolder, "MessagesInFolder"
+		}
+		ms, err := search(c.arg)
+		if err != nil {
+			t.Fatalf("Error in %s(%q): %s", name, c.arg, err)
+		}
+		if ids := fmt.Sprint(drainIDs(t, ms)); ids != c.want {
+			t.Errorf("%s(%q) found %s, want %s", name, c.arg, ids, c.want)
+		}
+		ms.Close()
+	}
+}
+
+func TestSearchWithCount(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	for _, id := range []string{"a", "b", "c"} {
+		indexTestMessage(t, db, root, id, testMessage(id)).Close()
+	}
+	ms, n, err := db.SearchWithCount("*")
+	if err != nil {
+		t.Fatalf("Error in SearchWithCount: %s", err)
+	}
+	defer ms.Close()
+	if ids := drainIDs(t, ms); len(ids) != n || n != 3 {
+		t.Errorf("SearchWithCount counted %d, found %v", n, ids)
+	}
+}
+
+func TestNewQueryExcludes(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	indexTestMessage(t, db, root, "a", testMessage("a")).Close()
+	deleted := indexTestMessage(t, db, root, "b", testMessage("b"))
+	if err := deleted.AddTag("deleted"); err != nil {
+		t.Fatalf("Error adding tag: %s", err)
+	}
+	if err := db.SetConfigValues("search.exclude_tags", []string{"deleted"}); err != nil {
+		t.Fatalf("Error in SetConfigValues: %s", err)
+	}
+
+	for _, c := range []struct {
+		newQuery func(string) (*Query, error)
+		want     string
+	}{
+		{db.NewQuery, "[a@example.com]"},
+		{db.NewQueryRaw, "[a@example.com b@example.com]"},
+	} {
+		q, err := c.newQuery("*")
+		if err != nil {
+			t.Fatalf("Error creating query: %s", err)
+		}
+		ms, err := q.SearchMessages()
+		if err != nil {
+			t.Fatalf("Error in SearchMessages: %s", err)
+		}
+		if ids := fmt.Sprint(drainIDs(t, ms)); ids != c.want {
+			t.Errorf("Search found %s, want %s", ids, c.want)
+		}
+		q.Close()
+	}
+}
+
+func TestSearchAndOr(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	for id, tags := range map[string][]string{"a": {"a"}, "b": {"b"}, "ab": {"a", "b"}, "none": nil} {
+		msg := indexTestMessage(t, db, root, id, testMessage(id))
+		for _, tag := range tags {
+			if err := msg.AddTag(tag); err != nil {
+				t.Fatalf("Error adding tag: %s", err)
+			}
+		}
+		msg.Close()
+	}
+	for _, c := range []struct {
+		search func(...string) (*Messages, error)
+		want   string
+	}{
+		{db.SearchAnd, "[ab@example.com]"},
+		{db.SearchOr, "[a@example.com ab@example.com b@example.com]"},
+	} {
+		ms, err := c.search("tag:a", " ", "tag:b")
+		if err != nil {
+			t.Fatalf("Error searching: %s", err)
+		}
+		if ids := fmt.Sprint(drainIDs(t, ms)); ids != c.want {
+			t.Errorf("Search found %s, want %s", ids, c.want)
+		}
+		ms.Close()
+	}
+}
+
+func TestMessagesBetween(t *testing.T) {
+	db, root, cleanup := newTestDB(t)
+	defer cleanup()
+
+	for id, date := range map[string]string{
+		"feb": "Mon, 26 Feb 2018 10:00:00 +0000",
+		"mar": "Thu, 15 Mar 2018 10:00:00 +0000",
+		"apr": "Sun, 15 Apr 2018 10:00:00 +0000",
+	} {
+		indexTestMessage(t, db, root, id, testMessage(id, "Mon, 26 Feb 2018 00:00:00 +0200", date)).Close()
+	}
+	march := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	april := time.Date(2018, 4, 1, 0, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		start, end time.Time
+		want       string
+	}{
+		{march, april, "[mar@example.com]"},
+		{march, time.Time{}, "[apr@example.com mar@example.com]"},
+		{time.Time{}, march, "[feb@example.com]"},
+		{time.Time{}, time.Time{}, "[apr@example.com feb@example.com mar@example.com]"},
+	} {
+		ms, err := db.MessagesBetween(c.start, c.end)
+		if err != nil {
+			t.Fatalf("Error in MessagesBetween: %s", err)
+		}
+		if ids := fmt.Sprint(drainIDs(t, ms)); ids != c.want {
+			t.Errorf("MessagesBetween(%v, %v) found %s, want %s", c.start, c.end, ids, c.want)
+		}
+		ms.Close()
+	}
+}